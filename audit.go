@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// auditEntry is one line of the audit log, describing a single write to
+// the database.
+type auditEntry struct {
+	Time       time.Time   `json:"time"`
+	Step       string      `json:"step,omitempty"`
+	Live       bool        `json:"live"`
+	Action     string      `json:"action"`
+	Collection string      `json:"collection,omitempty"`
+	ID         interface{} `json:"id,omitempty"`
+	Assert     interface{} `json:"assert,omitempty"`
+	Detail     interface{} `json:"detail,omitempty"`
+	Result     string      `json:"result"`
+}
+
+// auditLog appends a JSON line for every database write. Lines are written
+// straight to the file so that nothing is lost if the upgrade is
+// interrupted.
+type auditLog struct {
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Annotate(err, "opening audit log")
+	}
+	return &auditLog{file: file}, nil
+}
+
+func (a *auditLog) write(entry auditEntry) {
+	entry.ID = auditValue(entry.ID)
+	entry.Assert = auditValue(entry.Assert)
+	entry.Detail = auditValue(entry.Detail)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Errorf("encoding audit entry for %s %s %v: %v", entry.Action, entry.Collection, entry.ID, err)
+		return
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		logger.Errorf("writing audit log: %v", err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	return errors.Trace(a.file.Close())
+}
+
+// auditValue converts values to plain documents, so that bson.D and
+// structs with bson tags are written as they would be stored.
+func auditValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	doc, err := toBSONM(bson.M{"v": value})
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return doc["v"]
+}
+
+// audit records a write to the audit log, if there is one.
+func (db *database) audit(entry auditEntry, err error) {
+	if db.auditLog == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Step = db.step
+	switch {
+	case err != nil:
+		entry.Result = err.Error()
+	case entry.Live:
+		entry.Result = "ok"
+	default:
+		entry.Result = "dry-run"
+	}
+	db.auditLog.write(entry)
+}
+
+func txnOpAuditEntry(op txn.Op, live bool) auditEntry {
+	entry := auditEntry{
+		Live:       live,
+		Collection: op.C,
+		ID:         op.Id,
+		Assert:     op.Assert,
+	}
+	switch {
+	case op.Insert != nil:
+		entry.Action = "txn-insert"
+		entry.Detail = op.Insert
+	case op.Remove:
+		entry.Action = "txn-remove"
+	case op.Update != nil:
+		entry.Action = "txn-update"
+		entry.Detail = op.Update
+	default:
+		entry.Action = "txn-assert"
+	}
+	return entry
+}
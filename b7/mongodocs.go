@@ -1,5 +1,7 @@
 package b7
 
+import "time"
+
 type SettingsDoc struct {
 	DocID     string `bson:"_id"`
 	ModelUUID string `bson:"model-uuid"`
@@ -22,6 +24,15 @@ type ModelDoc struct {
 	ServerUUID string `bson:"server-uuid"`
 }
 
+type UserDoc struct {
+	DocID       string    `bson:"_id"`
+	Name        string    `bson:"name"`
+	DisplayName string    `bson:"displayname"`
+	Deactivated bool      `bson:"deactivated,omitempty"`
+	CreatedBy   string    `bson:"createdby"`
+	DateCreated time.Time `bson:"datecreated"`
+}
+
 type Address struct {
 	Value       string `bson:"value"`
 	AddressType string `bson:"addresstype"`
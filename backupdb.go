@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	goyaml "gopkg.in/yaml.v2"
+)
+
+const (
+	backupManifestFilename = "manifest.yaml"
+	backupTimeFormat       = "20060102-150405"
+
+	// backupMaxAge is how old the most recent backup can be before
+	// upgrade-db --live refuses to run.
+	backupMaxAge = 6 * time.Hour
+
+	restoreBatchSize = 1000
+)
+
+// backupDatabases are the databases dumped by backup-db.
+var backupDatabases = []string{"juju", "blobstore", "logs"}
+
+type backupManifest struct {
+	Created  time.Time `yaml:"created"`
+	Verified bool      `yaml:"verified"`
+	// UpgradeStarted is set if upgrade-db had already been started when
+	// the backup was taken, so the databases may be partly upgraded.
+	UpgradeStarted bool               `yaml:"upgrade-started,omitempty"`
+	Collections    []backupCollection `yaml:"collections"`
+}
+
+type backupCollection struct {
+	Database string                  `yaml:"database"`
+	Name     string                  `yaml:"name"`
+	File     string                  `yaml:"file"`
+	Count    int                     `yaml:"count"`
+	SHA256   string                  `yaml:"sha256"`
+	Options  backupCollectionOptions `yaml:"options,omitempty"`
+	Indexes  []backupIndex           `yaml:"indexes,omitempty"`
+}
+
+// backupCollectionOptions are the options the collection was created
+// with, like the capped txns.log.
+type backupCollectionOptions struct {
+	Capped   bool `yaml:"capped,omitempty"`
+	MaxBytes int  `yaml:"max-bytes,omitempty"`
+	MaxDocs  int  `yaml:"max-docs,omitempty"`
+}
+
+type backupIndex struct {
+	Name             string         `yaml:"name"`
+	Key              []string       `yaml:"key"`
+	Unique           bool           `yaml:"unique,omitempty"`
+	DropDups         bool           `yaml:"drop-dups,omitempty"`
+	Background       bool           `yaml:"background,omitempty"`
+	Sparse           bool           `yaml:"sparse,omitempty"`
+	ExpireAfter      time.Duration  `yaml:"expire-after,omitempty"`
+	Min              float64        `yaml:"min,omitempty"`
+	Max              float64        `yaml:"max,omitempty"`
+	BucketSize       float64        `yaml:"bucket-size,omitempty"`
+	Bits             int            `yaml:"bits,omitempty"`
+	DefaultLanguage  string         `yaml:"default-language,omitempty"`
+	LanguageOverride string         `yaml:"language-override,omitempty"`
+	Weights          map[string]int `yaml:"weights,omitempty"`
+}
+
+// backupDB dumps every collection of the juju, blobstore and logs databases
+// into a new timestamped directory under the backup dir. Each collection is
+// written as a stream of raw BSON documents, and the manifest records the
+// document counts, checksums, collection options and indices needed to
+// restore them. A backup taken once upgrade-db has started is marked as
+// such, and is never picked as the latest backup.
+func (c *upgrade) backupDB(ctx *cmd.Context) error {
+	if len(c.args) > 0 {
+		return errors.Errorf("unexpected args: %v", c.args)
+	}
+
+	j, err := readJournal(journalPath())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+
+	manifest := backupManifest{
+		Created:        time.Now().UTC(),
+		UpgradeStarted: upgradeDBStarted(j),
+	}
+	dir := filepath.Join(c.backupDir, manifest.Created.Format(backupTimeFormat))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Trace(err)
+	}
+	ctx.Infof("Backing up to %s", dir)
+	if manifest.UpgradeStarted {
+		ctx.Infof("upgrade-db has been started, this backup will not be used by upgrade-db or restore-db unless named")
+	}
+
+	for _, dbName := range backupDatabases {
+		mdb := db.session.DB(dbName)
+		names, err := mdb.CollectionNames()
+		if err != nil {
+			return errors.Annotatef(err, "listing collections in %q", dbName)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, dbName), 0700); err != nil {
+			return errors.Trace(err)
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, "system.") {
+				continue
+			}
+			entry, err := dumpCollection(mdb.C(name), dir)
+			if err != nil {
+				return errors.Annotatef(err, "dumping %s.%s", dbName, name)
+			}
+			ctx.Infof("  %s.%s: %d docs", dbName, name, entry.Count)
+			manifest.Collections = append(manifest.Collections, entry)
+		}
+	}
+
+	ctx.Infof("Verifying backup")
+	if err := verifyBackup(dir, manifest); err != nil {
+		return errors.Trace(err)
+	}
+	manifest.Verified = true
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return errors.Trace(err)
+	}
+	ctx.Infof("Backup complete: %s", dir)
+	return nil
+}
+
+func dumpCollection(coll *mgo.Collection, dir string) (_ backupCollection, err error) {
+	entry := backupCollection{
+		Database: coll.Database.Name,
+		Name:     coll.Name,
+		File:     filepath.Join(coll.Database.Name, coll.Name+".bson"),
+	}
+
+	entry.Options, err = collectionOptions(coll)
+	if err != nil {
+		return entry, errors.Trace(err)
+	}
+
+	indexes, err := coll.Indexes()
+	if err != nil {
+		return entry, errors.Annotate(err, "getting indices")
+	}
+	for _, idx := range indexes {
+		if idx.Name == "_id_" {
+			continue
+		}
+		entry.Indexes = append(entry.Indexes, backupIndex{
+			Name:             idx.Name,
+			Key:              idx.Key,
+			Unique:           idx.Unique,
+			DropDups:         idx.DropDups,
+			Background:       idx.Background,
+			Sparse:           idx.Sparse,
+			ExpireAfter:      idx.ExpireAfter,
+			Min:              idx.Minf,
+			Max:              idx.Maxf,
+			BucketSize:       idx.BucketSize,
+			Bits:             idx.Bits,
+			DefaultLanguage:  idx.DefaultLanguage,
+			LanguageOverride: idx.LanguageOverride,
+			Weights:          idx.Weights,
+		})
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, entry.File), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return entry, errors.Trace(err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = errors.Trace(closeErr)
+		}
+	}()
+
+	hash := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(f, hash))
+
+	var raw bson.Raw
+	iter := coll.Find(nil).Snapshot().Iter()
+	defer iter.Close()
+	for iter.Next(&raw) {
+		if _, err := out.Write(raw.Data); err != nil {
+			return entry, errors.Trace(err)
+		}
+		entry.Count++
+	}
+	if err := iter.Err(); err != nil {
+		return entry, errors.Trace(err)
+	}
+	if err := out.Flush(); err != nil {
+		return entry, errors.Trace(err)
+	}
+	entry.SHA256 = fmt.Sprintf("%x", hash.Sum(nil))
+	return entry, nil
+}
+
+// collectionOptions reads the options the collection was created with.
+func collectionOptions(coll *mgo.Collection) (backupCollectionOptions, error) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Options struct {
+					Capped bool `bson:"capped"`
+					Size   int  `bson:"size"`
+					Max    int  `bson:"max"`
+				} `bson:"options"`
+			} `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}
+	err := coll.Database.Run(bson.D{
+		{"listCollections", 1},
+		{"filter", bson.D{{"name", coll.Name}}},
+	}, &result)
+	if err != nil {
+		return backupCollectionOptions{}, errors.Annotate(err, "getting collection options")
+	}
+	if len(result.Cursor.FirstBatch) == 0 {
+		return backupCollectionOptions{}, errors.NotFoundf("collection %q", coll.Name)
+	}
+	options := result.Cursor.FirstBatch[0].Options
+	return backupCollectionOptions{
+		Capped:   options.Capped,
+		MaxBytes: options.Size,
+		MaxDocs:  options.Max,
+	}, nil
+}
+
+// readBackupDocs calls fn with each raw BSON document in the file, and
+// returns the file's checksum.
+func readBackupDocs(filename string, fn func([]byte) error) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	in := bufio.NewReader(io.TeeReader(f, hash))
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(in, header[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", errors.Annotatef(err, "reading %q", filename)
+		}
+		size := int(binary.LittleEndian.Uint32(header[:]))
+		if size < len(header) {
+			return "", errors.Errorf("corrupt document in %q", filename)
+		}
+		doc := make([]byte, size)
+		copy(doc, header[:])
+		if _, err := io.ReadFull(in, doc[len(header):]); err != nil {
+			return "", errors.Annotatef(err, "reading %q", filename)
+		}
+		if fn != nil {
+			if err := fn(doc); err != nil {
+				return "", errors.Trace(err)
+			}
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// verifyBackup re-reads every file in the backup and checks it against
+// the document count and checksum in the manifest.
+func verifyBackup(dir string, manifest backupManifest) error {
+	for _, entry := range manifest.Collections {
+		count := 0
+		sum, err := readBackupDocs(filepath.Join(dir, entry.File), func([]byte) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if sum != entry.SHA256 {
+			return errors.Errorf("checksum mismatch for %s: expected %s, got %s", entry.File, entry.SHA256, sum)
+		}
+		if count != entry.Count {
+			return errors.Errorf("document count mismatch for %s: expected %d, got %d", entry.File, entry.Count, count)
+		}
+	}
+	return nil
+}
+
+func writeBackupManifest(dir string, manifest backupManifest) error {
+	data, err := goyaml.Marshal(manifest)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(filepath.Join(dir, backupManifestFilename), data, 0600))
+}
+
+func readBackupManifest(dir string) (backupManifest, error) {
+	var manifest backupManifest
+	data, err := ioutil.ReadFile(filepath.Join(dir, backupManifestFilename))
+	if err != nil {
+		return manifest, errors.Annotate(err, "reading backup manifest")
+	}
+	if err := goyaml.Unmarshal(data, &manifest); err != nil {
+		return manifest, errors.Annotatef(err, "parsing backup manifest in %q", dir)
+	}
+	return manifest, nil
+}
+
+// upgradeDBStarted returns true if the journal shows that upgrade-db has
+// been started and not rolled back.
+func upgradeDBStarted(j *journal) bool {
+	entry, found := j.last(phaseUpgradeDB)
+	return found && entry.Event != eventRolledBack
+}
+
+// latestBackup returns the directory of the most recent backup under
+// backupDir that was taken before upgrade-db started. Backup directories
+// are named by time, so sort in order.
+func latestBackup(backupDir string) (string, error) {
+	infos, err := ioutil.ReadDir(backupDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Trace(err)
+	}
+	var names []string
+	for _, info := range infos {
+		if _, err := time.Parse(backupTimeFormat, info.Name()); info.IsDir() && err == nil {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for i := len(names) - 1; i >= 0; i-- {
+		dir := filepath.Join(backupDir, names[i])
+		manifest, err := readBackupManifest(dir)
+		if err != nil {
+			logger.Warningf("skipping backup %s: %v", dir, err)
+			continue
+		}
+		if manifest.UpgradeStarted {
+			logger.Infof("skipping backup %s, taken after upgrade-db started", dir)
+			continue
+		}
+		return dir, nil
+	}
+	return "", errors.NotFoundf("backup taken before upgrade-db started in %q", backupDir)
+}
+
+// checkRecentBackup returns an error unless the most recent backup was
+// verified, is younger than backupMaxAge, and still matches its checksums.
+func checkRecentBackup(backupDir string) error {
+	dir, err := latestBackup(backupDir)
+	if err != nil {
+		return errors.Annotate(err, "run backup-db first")
+	}
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !manifest.Verified {
+		return errors.Errorf("backup %q was not verified, run backup-db again", dir)
+	}
+	if age := time.Since(manifest.Created); age > backupMaxAge {
+		return errors.Errorf("backup %q is %v old, run backup-db again", dir, age)
+	}
+	if err := verifyBackup(dir, manifest); err != nil {
+		return errors.Annotatef(err, "backup %q", dir)
+	}
+	logger.Infof("using backup %s", dir)
+	return nil
+}
+
+// restoreDB replaces the juju, blobstore and logs databases with the
+// contents of a backup. Collections not in the backup, like those created
+// by upgrade-db, are dropped, and the undo log is cleared. Defaults to the
+// most recent backup.
+func (c *upgrade) restoreDB(ctx *cmd.Context) error {
+	if len(c.args) > 1 {
+		return errors.Errorf("unexpected args: %v", c.args[1:])
+	}
+	var dir string
+	if len(c.args) == 1 {
+		dir = filepath.Join(c.backupDir, c.args[0])
+	} else {
+		var err error
+		if dir, err = latestBackup(c.backupDir); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if c.live {
+		j, err := readJournal(journalPath())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := checkAgentsStopped(j); err != nil {
+			return errors.Annotate(err, "restore-db --live needs the agents stopped")
+		}
+	}
+
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !manifest.Verified {
+		return errors.Errorf("backup %q was not verified, it can't be restored", dir)
+	}
+	ctx.Infof("Verifying backup %s", dir)
+	if err := verifyBackup(dir, manifest); err != nil {
+		return errors.Trace(err)
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+
+	backedUp := make(map[string]bool)
+	for _, entry := range manifest.Collections {
+		backedUp[entry.Database+"."+entry.Name] = true
+	}
+	for _, dbName := range backupDatabases {
+		names, err := db.session.DB(dbName).CollectionNames()
+		if err != nil {
+			return errors.Annotatef(err, "listing collections in %q", dbName)
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, "system.") || backedUp[dbName+"."+name] {
+				continue
+			}
+			ctx.Infof("Drop %s.%s, not in backup", dbName, name)
+			if c.live {
+				if err := db.session.DB(dbName).C(name).DropCollection(); err != nil {
+					return errors.Annotatef(err, "dropping %s.%s", dbName, name)
+				}
+			}
+		}
+	}
+
+	for _, entry := range manifest.Collections {
+		ctx.Infof("Restore %s.%s: %d docs", entry.Database, entry.Name, entry.Count)
+		if !c.live {
+			continue
+		}
+		if err := restoreCollection(db.session.DB(entry.Database).C(entry.Name), dir, entry); err != nil {
+			return errors.Annotatef(err, "restoring %s.%s", entry.Database, entry.Name)
+		}
+	}
+
+	// The undo log holds documents from before the restore, which undo-db
+	// must not write back over the restored data.
+	ctx.Infof("Clear the undo log %s.%s", undoDatabase, undoCollection)
+	if c.live {
+		if err := dropCollectionIfExists(db.undoLog()); err != nil {
+			return errors.Annotate(err, "clearing undo log")
+		}
+	}
+	return nil
+}
+
+// dropCollectionIfExists drops the collection, doing nothing if there is
+// no such collection.
+func dropCollectionIfExists(coll *mgo.Collection) error {
+	names, err := coll.Database.CollectionNames()
+	if err != nil {
+		return errors.Annotatef(err, "listing collections in %q", coll.Database.Name)
+	}
+	for _, name := range names {
+		if name == coll.Name {
+			return errors.Trace(coll.DropCollection())
+		}
+	}
+	return nil
+}
+
+// checkAgentsStopped returns an error unless the journal shows that the
+// agents have been stopped and not started again.
+func checkAgentsStopped(j *journal) error {
+	if entry, found := j.last(phaseStopAgents); !found || entry.Event != eventCompleted {
+		return errors.Errorf("%q has not completed (see %s)", phaseStopAgents, j.path)
+	}
+	for _, phase := range []string{phaseStartController, phaseStartOthers} {
+		if entry, found := j.last(phase); found && entry.Event != eventRolledBack {
+			return errors.Errorf("%q has already been %s (see %s)", phase, entry.Event, j.path)
+		}
+	}
+	return nil
+}
+
+func restoreCollection(coll *mgo.Collection, dir string, entry backupCollection) error {
+	if err := dropCollectionIfExists(coll); err != nil {
+		return errors.Trace(err)
+	}
+	// Create the collection first, so that it has the same options, and
+	// so that empty collections are kept.
+	err := coll.Create(&mgo.CollectionInfo{
+		Capped:   entry.Options.Capped,
+		MaxBytes: entry.Options.MaxBytes,
+		MaxDocs:  entry.Options.MaxDocs,
+	})
+	if err != nil {
+		return errors.Annotate(err, "creating collection")
+	}
+
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		bulk := coll.Bulk()
+		bulk.Insert(batch...)
+		batch = nil
+		_, err := bulk.Run()
+		return errors.Trace(err)
+	}
+	_, err = readBackupDocs(filepath.Join(dir, entry.File), func(doc []byte) error {
+		batch = append(batch, bson.Raw{Kind: 0x03, Data: doc})
+		if len(batch) < restoreBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := flush(); err != nil {
+		return errors.Trace(err)
+	}
+	for _, idx := range entry.Indexes {
+		err := coll.EnsureIndex(mgo.Index{
+			Name:             idx.Name,
+			Key:              idx.Key,
+			Unique:           idx.Unique,
+			DropDups:         idx.DropDups,
+			Background:       idx.Background,
+			Sparse:           idx.Sparse,
+			ExpireAfter:      idx.ExpireAfter,
+			Minf:             idx.Min,
+			Maxf:             idx.Max,
+			BucketSize:       idx.BucketSize,
+			Bits:             idx.Bits,
+			DefaultLanguage:  idx.DefaultLanguage,
+			LanguageOverride: idx.LanguageOverride,
+			Weights:          idx.Weights,
+		})
+		if err != nil {
+			return errors.Annotatef(err, "creating index %q", idx.Name)
+		}
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ func (c *upgrade) cleanDB(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 	defer db.Close()
+	db.auditLog = c.audit
 
 	fmt.Fprintln(ctx.Stdout, "Cleaning cleanups")
 
@@ -26,7 +27,7 @@ func (c *upgrade) cleanDB(ctx *cmd.Context) error {
 func (c *upgrade) removeCleanups(ctx *cmd.Context, db *database) error {
 	coll := db.GetCollection(cleanupsC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.M
 	iter := coll.Find(nil).Iter()
@@ -34,7 +35,7 @@ func (c *upgrade) removeCleanups(ctx *cmd.Context, db *database) error {
 	for iter.Next(&doc) {
 		fmt.Fprintf(ctx.Stdout, "Adding %s: %q\n", doc["kind"], doc["prefix"])
 
-		ops = append(ops, txn.Op{
+		ops.add(txn.Op{
 			C:      cleanupsC,
 			Id:     doc["_id"],
 			Remove: true,
@@ -46,11 +47,12 @@ func (c *upgrade) removeCleanups(ctx *cmd.Context, db *database) error {
 
 	if len(ops) > 0 {
 		runner := db.TransactionRunner(ctx, c.live)
-		if err := runner.RunTransaction(ops); err != nil {
+		if err := runner.RunGroups(ops); err != nil {
 			return errors.Trace(err)
 		}
 	}
 
+	c.setResult(cleanDBResult{Removed: len(ops)})
 	if c.live {
 		fmt.Fprintf(ctx.Stdout, "%d cleanup docs removed.\n", len(ops))
 	} else {
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils/set"
+	"gopkg.in/mgo.v2"
+
+	"github.com/howbazaar/b7-upgrade/b7"
+	"github.com/howbazaar/b7-upgrade/rc"
+)
+
+// providerUpgrade describes how the cloud details held in the model
+// settings of one beta7 provider type move into the 2.0 clouds and
+// cloudCredentials collections.
+type providerUpgrade struct {
+	// cloudName is the name of the 2.0 cloud. It defaults to the
+	// provider type.
+	cloudName string
+	// cloud fills in the auth types, endpoint and regions of the cloud
+	// from the controller model settings. The regions are all those
+	// used by the models.
+	cloud func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error
+	// credential returns the auth type and attributes of the credential
+	// held in the model settings. It is nil for clouds that have no
+	// credential.
+	credential func(settings b7.SettingsMap) (string, map[string]string, error)
+	// regionSetting is the model setting that holds the cloud region of
+	// the model, if the cloud has regions.
+	regionSetting string
+	// regionName, if set, converts the region setting to the 2.0 region
+	// name.
+	regionName func(string) string
+	// removedSettings are the provider settings that are no longer part
+	// of the model config.
+	removedSettings []string
+}
+
+var providerUpgrades = map[string]providerUpgrade{
+	"lxd": {
+		cloud: func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error {
+			cloud.AuthTypes = []string{"empty"}
+			cloud.Regions = map[string]rc.CloudRegionSubdoc{
+				"localhost": rc.CloudRegionSubdoc{},
+			}
+			return nil
+		},
+		credential: func(settings b7.SettingsMap) (string, map[string]string, error) {
+			return "empty", nil, nil
+		},
+		removedSettings: []string{
+			"client-cert",
+			"client-key",
+			"namespace",
+			"remote-url",
+			"server-cert",
+		},
+	},
+	"maas": {
+		cloud: func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error {
+			endpoint, err := stringSetting(settings, "maas-server")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			cloud.AuthTypes = []string{"oauth1"}
+			cloud.Endpoint = endpoint
+			return nil
+		},
+		credential: func(settings b7.SettingsMap) (string, map[string]string, error) {
+			attributes, err := settingsAttributes(settings, "maas-oauth")
+			return "oauth1", attributes, errors.Trace(err)
+		},
+		removedSettings: []string{
+			"maas-agent-name",
+			"maas-oauth",
+			"maas-server",
+		},
+	},
+	"openstack": {
+		cloud: func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error {
+			endpoint, err := stringSetting(settings, "auth-url")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			cloud.AuthTypes = []string{"access-key", "userpass"}
+			cloud.Endpoint = endpoint
+			cloud.Regions = make(map[string]rc.CloudRegionSubdoc)
+			for _, region := range regions.Values() {
+				cloud.Regions[region] = rc.CloudRegionSubdoc{Endpoint: endpoint}
+			}
+			return nil
+		},
+		credential: func(settings b7.SettingsMap) (string, map[string]string, error) {
+			if mode, _ := settings["auth-mode"].(string); mode == "keypair" {
+				attributes, err := settingsAttributes(settings, "access-key", "secret-key", "tenant-name")
+				return "access-key", attributes, errors.Trace(err)
+			}
+			attributes, err := settingsAttributes(settings, "username", "password", "tenant-name")
+			return "userpass", attributes, errors.Trace(err)
+		},
+		regionSetting: "region",
+		removedSettings: []string{
+			"access-key",
+			"auth-mode",
+			"auth-url",
+			"password",
+			"region",
+			"secret-key",
+			"tenant-name",
+			"username",
+		},
+	},
+	"ec2": {
+		cloudName: "aws",
+		cloud: func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error {
+			cloud.AuthTypes = []string{"access-key"}
+			cloud.Regions = make(map[string]rc.CloudRegionSubdoc)
+			for _, region := range regions.Union(set.NewStrings(awsRegions...)).Values() {
+				cloud.Regions[region] = rc.CloudRegionSubdoc{
+					Endpoint: fmt.Sprintf("https://ec2.%s.amazonaws.com", region),
+				}
+			}
+			return nil
+		},
+		credential: func(settings b7.SettingsMap) (string, map[string]string, error) {
+			attributes, err := settingsAttributes(settings, "access-key", "secret-key")
+			return "access-key", attributes, errors.Trace(err)
+		},
+		regionSetting: "region",
+		removedSettings: []string{
+			"access-key",
+			"region",
+			"secret-key",
+		},
+	},
+	"gce": {
+		cloudName: "google",
+		cloud: func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error {
+			cloud.AuthTypes = []string{"oauth2"}
+			cloud.Endpoint = googleEndpoint
+			cloud.Regions = make(map[string]rc.CloudRegionSubdoc)
+			for _, region := range regions.Union(set.NewStrings(googleRegions...)).Values() {
+				cloud.Regions[region] = rc.CloudRegionSubdoc{Endpoint: googleEndpoint}
+			}
+			return nil
+		},
+		credential: func(settings b7.SettingsMap) (string, map[string]string, error) {
+			attributes, err := settingsAttributes(settings, "client-id", "client-email", "private-key", "project-id")
+			return "oauth2", attributes, errors.Trace(err)
+		},
+		regionSetting: "region",
+		removedSettings: []string{
+			"client-email",
+			"client-id",
+			"private-key",
+			"project-id",
+			"region",
+		},
+	},
+	"azure": {
+		cloud: func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error {
+			endpoint, _ := settings["endpoint"].(string)
+			if endpoint == "" {
+				endpoint = azureEndpoint
+			}
+			storageEndpoint, _ := settings["storage-endpoint"].(string)
+			if storageEndpoint == "" {
+				storageEndpoint = azureStorageEndpoint
+			}
+			cloud.AuthTypes = []string{"service-principal-secret"}
+			cloud.Endpoint = endpoint
+			cloud.IdentityEndpoint = azureIdentityEndpoint
+			cloud.StorageEndpoint = storageEndpoint
+			cloud.Regions = make(map[string]rc.CloudRegionSubdoc)
+			for _, region := range regions.Values() {
+				cloud.Regions[region] = rc.CloudRegionSubdoc{
+					Endpoint:         endpoint,
+					IdentityEndpoint: azureIdentityEndpoint,
+					StorageEndpoint:  storageEndpoint,
+				}
+			}
+			return nil
+		},
+		credential: func(settings b7.SettingsMap) (string, map[string]string, error) {
+			attributes, err := settingsAttributes(settings, "application-id", "application-password", "subscription-id")
+			return "service-principal-secret", attributes, errors.Trace(err)
+		},
+		regionSetting: "location",
+		regionName:    azureRegionName,
+		// The 2.0 azure provider discovers the tenant from the
+		// subscription, so tenant-id is not carried into the
+		// credential.
+		removedSettings: []string{
+			"application-id",
+			"application-password",
+			"controller-resource-group",
+			"endpoint",
+			"location",
+			"storage-account",
+			"storage-account-key",
+			"storage-endpoint",
+			"subscription-id",
+			"tenant-id",
+		},
+	},
+	"manual": {
+		cloud: func(cloud *rc.CloudDoc, settings b7.SettingsMap, regions set.Strings) error {
+			endpoint, err := stringSetting(settings, "bootstrap-host")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			cloud.AuthTypes = []string{"empty"}
+			cloud.Endpoint = endpoint
+			return nil
+		},
+		removedSettings: []string{
+			"bootstrap-host",
+			"bootstrap-user",
+			"use-sshstorage",
+		},
+	},
+}
+
+// awsRegions are the regions of the public aws cloud.
+var awsRegions = []string{
+	"ap-northeast-1",
+	"ap-northeast-2",
+	"ap-south-1",
+	"ap-southeast-1",
+	"ap-southeast-2",
+	"eu-central-1",
+	"eu-west-1",
+	"sa-east-1",
+	"us-east-1",
+	"us-east-2",
+	"us-west-1",
+	"us-west-2",
+}
+
+const googleEndpoint = "https://www.googleapis.com"
+
+// googleRegions are the regions of the public google cloud.
+var googleRegions = []string{
+	"asia-east1",
+	"europe-west1",
+	"us-central1",
+	"us-east1",
+	"us-west1",
+}
+
+const (
+	azureEndpoint         = "https://management.azure.com"
+	azureIdentityEndpoint = "https://graph.windows.net"
+	azureStorageEndpoint  = "https://core.windows.net"
+)
+
+// azureRegionName converts a beta7 azure location, which may be written
+// as a display name like "West US", to the 2.0 region name "westus".
+func azureRegionName(location string) string {
+	return strings.ToLower(strings.Replace(location, " ", "", -1))
+}
+
+func stringSetting(settings b7.SettingsMap, name string) (string, error) {
+	value, ok := settings[name].(string)
+	if !ok || value == "" {
+		return "", errors.Errorf("%q missing from model settings", name)
+	}
+	return value, nil
+}
+
+// settingsAttributes returns the named settings as credential attributes.
+func settingsAttributes(settings b7.SettingsMap, names ...string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for _, name := range names {
+		value, err := stringSetting(settings, name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		attributes[name] = value
+	}
+	return attributes, nil
+}
+
+// getProviderUpgrade returns the details for the provider type of the
+// controller.
+func getProviderUpgrade(cloudType string) (providerUpgrade, error) {
+	provider, found := providerUpgrades[cloudType]
+	if !found {
+		return providerUpgrade{}, errors.Errorf("unsupported cloud type %q", cloudType)
+	}
+	return provider, nil
+}
+
+func (p providerUpgrade) name(cloudType string) string {
+	if p.cloudName != "" {
+		return p.cloudName
+	}
+	return cloudType
+}
+
+// modelRegion returns the cloud region of the model with the given
+// settings, or "" if the cloud has no regions.
+func (p providerUpgrade) modelRegion(settings b7.SettingsMap) string {
+	if p.regionSetting == "" {
+		return ""
+	}
+	region, _ := settings[p.regionSetting].(string)
+	if region != "" && p.regionName != nil {
+		region = p.regionName(region)
+	}
+	return region
+}
+
+// modelSettings returns the settings of the model.
+func modelSettings(db *database, modelUUID string) (b7.SettingsMap, error) {
+	var doc b7.SettingsDoc
+	err := db.GetCollection(settingsC).FindId(modelUUID + ":e").One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, errors.NotFoundf("settings for model %q", modelUUID)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "getting settings for model %q", modelUUID)
+	}
+	return doc.Settings, nil
+}
+
+// modelRegions returns the cloud regions used by all of the models.
+func modelRegions(context *dbUpgradeContext, provider providerUpgrade) (set.Strings, error) {
+	regions := set.NewStrings()
+	var model b7.ModelDoc
+	iter := context.db.GetCollection(modelsC).Find(nil).Iter()
+	defer iter.Close()
+	for iter.Next(&model) {
+		settings, err := modelSettings(context.db, model.UUID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if region := provider.modelRegion(settings); region != "" {
+			regions.Add(region)
+		}
+	}
+	return regions, errors.Annotate(iter.Err(), "reading models")
+}
+
+// cloudsWithoutCredentials returns the names of the clouds whose models
+// have no cloud credential.
+func cloudsWithoutCredentials() []string {
+	var names []string
+	for cloudType, provider := range providerUpgrades {
+		if provider.credential == nil {
+			names = append(names, provider.name(cloudType))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// controllerCloud returns the cloud and credential documents for the
+// controller, built from the controller model settings. An imported
+// credential is used in place of the one in the settings. The credential
+// is nil if the cloud has none.
+func controllerCloud(context *dbUpgradeContext) (rc.CloudDoc, *rc.CloudCredentialDoc, error) {
+	provider, err := getProviderUpgrade(context.cloudType)
+	if err != nil {
+		return rc.CloudDoc{}, nil, errors.Trace(err)
+	}
+	settings := context.controllerModelSettings.Settings
+
+	regions, err := modelRegions(context, provider)
+	if err != nil {
+		return rc.CloudDoc{}, nil, errors.Trace(err)
+	}
+	cloud := rc.CloudDoc{
+		Name: context.cloud,
+		Type: context.cloudType,
+	}
+	if err := provider.cloud(&cloud, settings, regions); err != nil {
+		return rc.CloudDoc{}, nil, errors.Annotatef(err, "%s cloud", context.cloudType)
+	}
+	if imported := context.importedCredential; imported != nil {
+		return cloud, &rc.CloudCredentialDoc{
+			Owner:      localUserID(context.owner),
+			Cloud:      context.cloud,
+			Name:       imported.name,
+			AuthType:   imported.authType,
+			Attributes: imported.attributes,
+		}, nil
+	}
+	if provider.credential == nil {
+		return cloud, nil, nil
+	}
+
+	authType, attributes, err := provider.credential(settings)
+	if err != nil {
+		return rc.CloudDoc{}, nil, errors.Annotatef(err, "%s credential", context.cloudType)
+	}
+	credential := &rc.CloudCredentialDoc{
+		Owner:      localUserID(context.owner),
+		Cloud:      context.cloud,
+		Name:       context.cloud,
+		AuthType:   authType,
+		Attributes: attributes,
+	}
+	return cloud, credential, nil
+}
+
+// credentialDocID returns the id of the cloudCredentials document for the
+// credential.
+func credentialDocID(credential rc.CloudCredentialDoc) string {
+	return fmt.Sprintf("%s#%s#%s", credential.Cloud, credential.Owner, credential.Name)
+}
@@ -18,8 +18,31 @@ var logger = loggo.GetLogger("b7-upgrade")
 
 type upgrade struct {
 	live   bool
+	yes    bool
 	action func(*cmd.Context) error
 
+	backupDir string
+	only      string
+	skip      string
+
+	controllerUUID string
+	credentials    string
+	credentialName string
+
+	diff     bool
+	diffJSON string
+	plan     string
+
+	batchSize int
+	step      string
+
+	auditLogPath string
+	audit        *auditLog
+
+	format     string
+	actionName string
+	result     interface{}
+
 	debug  bool
 	jdebug bool
 	args   []string
@@ -50,6 +73,20 @@ func (c *upgrade) AllowInterspersedFlags() bool {
 // SetFlags implements Command.
 func (c *upgrade) SetFlags(f *gnuflag.FlagSet) {
 	f.BoolVar(&c.live, "live", false, "Do for real, not just dry-run")
+	f.BoolVar(&c.yes, "yes", false, "Don't ask for confirmation between run-all phases")
+	f.StringVar(&c.backupDir, "backup-dir", "/var/lib/juju/b7-upgrade-backup", "Directory for database backups")
+	f.StringVar(&c.only, "only", "", "Comma separated upgrade-db steps to run, see list-steps")
+	f.StringVar(&c.skip, "skip", "", "Comma separated upgrade-db steps to skip, see list-steps")
+	f.StringVar(&c.controllerUUID, "controller-uuid", "", "Controller UUID for upgrade-db to use instead of generating one")
+	f.StringVar(&c.credentials, "credentials", "", "A juju 2.0 credentials.yaml for upgrade-db to take the cloud credential from")
+	f.StringVar(&c.credentialName, "credential-name", "", "The credential to use from --credentials, if not the cloud's default")
+	f.BoolVar(&c.diff, "diff", false, "Show the document changes an upgrade-db dry-run would make")
+	f.StringVar(&c.diffJSON, "diff-json", "", "Write the document changes an upgrade-db dry-run would make to this file as JSON")
+	f.StringVar(&c.plan, "plan", "", "Write the transactions of an upgrade-db dry-run to this file, for apply-plan")
+	f.IntVar(&c.batchSize, "batch-size", defaultBatchSize, "Most ops for upgrade-db to put in one transaction")
+	f.StringVar(&c.step, "step", "", "The upgrade-db step for undo-db to reverse")
+	f.StringVar(&c.auditLogPath, "audit-log", "", "Append a JSON line for every database write to this file")
+	f.StringVar(&c.format, "format", formatText, "Output format: text, json or yaml")
 	f.BoolVar(&c.debug, "debug", false, "Show debug logging")
 	f.BoolVar(&c.jdebug, "jdebug", false, "Show juju debug logging")
 }
@@ -66,6 +103,10 @@ func (c *upgrade) Init(args []string) error {
 	} else {
 		c.action = f
 	}
+	if !validFormat(c.format) {
+		return errors.Errorf("unknown format %q, options are: text, json, yaml", c.format)
+	}
+	c.actionName = action
 	c.args = args
 	return nil
 }
@@ -81,11 +122,19 @@ func (c *upgrade) validCommands() string {
 
 func (c *upgrade) commands() map[string]func(ctx *cmd.Context) error {
 	return map[string]func(ctx *cmd.Context) error{
-		"verify-db":      c.verifyDB,
-		"agents":         c.agents,
-		"clean-db":       c.cleanDB,
-		"upgrade-db":     c.upgradeDB,
-		"upgrade-agents": c.upgradeAgents,
+		"verify-db":          c.phase(phaseVerifyDB, c.verifyDB),
+		"agents":             c.agents,
+		"clean-db":           c.cleanDB,
+		"backup-db":          c.backupDB,
+		"restore-db":         c.restoreDB,
+		"upgrade-db":         c.phase(phaseUpgradeDB, c.upgradeDB),
+		"upgrade-agents":     c.phase(phaseUpgradeAgents, c.upgradeAgents),
+		"apply-plan":         c.phase(phaseUpgradeDB, c.applyPlan),
+		"list-steps":         c.listSteps,
+		"verify-upgraded-db": c.verifyUpgradedDB,
+		"undo-db":            c.undoDB,
+		"progress":           c.progress,
+		"run-all":            c.runAll,
 	}
 }
 
@@ -104,7 +153,29 @@ func (c *upgrade) Run(ctx *cmd.Context) error {
 		logger.Infof("Running dry-run")
 	}
 
-	if err := c.action(ctx); err != nil {
+	if c.auditLogPath != "" {
+		audit, err := openAuditLog(c.auditLogPath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.audit = audit
+	}
+
+	stdout := ctx.Stdout
+	if c.format != formatText {
+		// Progress goes to stderr, leaving stdout for the result.
+		ctx.Stdout = ctx.Stderr
+	}
+	err := c.action(ctx)
+	if outputErr := c.writeOutput(stdout, err); outputErr != nil {
+		logger.Errorf("%v", outputErr)
+	}
+	if c.audit != nil {
+		if err := c.audit.Close(); err != nil {
+			logger.Errorf("closing audit log: %v", err)
+		}
+	}
+	if err != nil {
 		logger.Errorf("%v\n\n%s\n\n", err, errors.ErrorStack(err))
 		os.Exit(1)
 	}
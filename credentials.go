@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	goyaml "gopkg.in/yaml.v2"
+
+	"github.com/howbazaar/b7-upgrade/b7"
+	"github.com/howbazaar/b7-upgrade/rc"
+)
+
+// importedCredential is a credential read from a juju 2.0 credentials.yaml
+// file, used instead of the one held in the model settings.
+type importedCredential struct {
+	name       string
+	authType   string
+	attributes map[string]string
+}
+
+// credentialsFile is the layout of the juju 2.0 credentials.yaml file:
+//
+//	credentials:
+//	  <cloud>:
+//	    default-credential: <name>
+//	    <name>:
+//	      auth-type: <auth type>
+//	      <attribute>: <value>
+type credentialsFile struct {
+	Credentials map[string]map[string]interface{} `yaml:"credentials"`
+}
+
+// readCredentials reads the named credential for the cloud from the file.
+// If no name is given, the cloud's default credential is used, or its only
+// credential if it has just the one.
+func readCredentials(path, cloud, name string) (*importedCredential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading credentials")
+	}
+	var file credentialsFile
+	if err := goyaml.Unmarshal(data, &file); err != nil {
+		return nil, errors.Annotatef(err, "parsing credentials %q", path)
+	}
+	entries, found := file.Credentials[cloud]
+	if !found {
+		return nil, errors.Errorf("no credentials for cloud %q in %q", cloud, path)
+	}
+
+	var names []string
+	for key, value := range entries {
+		if _, ok := value.(map[interface{}]interface{}); ok {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	if name == "" {
+		name, _ = entries["default-credential"].(string)
+	}
+	if name == "" {
+		if len(names) != 1 {
+			return nil, errors.Errorf("cloud %q has credentials %s in %q, choose one with --credential-name",
+				cloud, strings.Join(names, ", "), path)
+		}
+		name = names[0]
+	}
+
+	entry, ok := entries[name].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.Errorf("credential %q for cloud %q not found in %q", name, cloud, path)
+	}
+	credential := &importedCredential{
+		name:       name,
+		attributes: make(map[string]string),
+	}
+	for key, value := range entry {
+		if fmt.Sprint(key) == "auth-type" {
+			credential.authType = fmt.Sprint(value)
+			continue
+		}
+		credential.attributes[fmt.Sprint(key)] = fmt.Sprint(value)
+	}
+	if credential.authType == "" {
+		return nil, errors.Errorf("credential %q for cloud %q has no auth-type", name, cloud)
+	}
+	if len(credential.attributes) == 0 {
+		credential.attributes = nil
+	}
+	return credential, nil
+}
+
+// checkAuthType returns an error if the cloud doesn't support the auth
+// type of the credential.
+func (p providerUpgrade) checkAuthType(settings b7.SettingsMap, credential *importedCredential) error {
+	var cloud rc.CloudDoc
+	if err := p.cloud(&cloud, settings, nil); err != nil {
+		return errors.Trace(err)
+	}
+	for _, authType := range cloud.AuthTypes {
+		if authType == credential.authType {
+			return nil
+		}
+	}
+	return errors.Errorf("credential %q has auth-type %q, cloud supports %s",
+		credential.name, credential.authType, strings.Join(cloud.AuthTypes, ", "))
+}
+
+// useImportedCredential checks the imported credential against the cloud,
+// and makes it the controller credential.
+func useImportedCredential(context *dbUpgradeContext, credential *importedCredential) error {
+	provider, err := getProviderUpgrade(context.cloudType)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := provider.checkAuthType(context.controllerModelSettings.Settings, credential); err != nil {
+		return errors.Annotatef(err, "%s cloud", context.cloudType)
+	}
+	context.importedCredential = credential
+	return nil
+}
+
+// credentialName returns the value used for the cloud-credential field of
+// models using the credential.
+func credentialName(credential rc.CloudCredentialDoc) string {
+	return fmt.Sprintf("%s/%s/%s", credential.Cloud, credential.Owner, credential.Name)
+}
+
+// modelCredential is the credential chosen for one model.
+type modelCredential struct {
+	modelUUID  string
+	modelName  string
+	owner      string
+	credential *rc.CloudCredentialDoc
+	// fromController is true if the model settings have no credential of
+	// their own, so the model uses the controller credential.
+	fromController bool
+}
+
+// modelCredentials works out the credential for each model from its owner,
+// as a 2.0 user id, and the provider secrets in its settings. Models with the same owner and
+// secrets share a credential. The controller credential is used for models
+// whose settings don't hold a credential, and an imported credential
+// replaces the secrets from the controller model settings wherever they
+// appear. It returns the credential for each model, keyed by model UUID,
+// along with the distinct credentials, the controller credential first.
+func modelCredentials(context *dbUpgradeContext, controller *rc.CloudCredentialDoc) (map[string]modelCredential, []rc.CloudCredentialDoc, error) {
+	provider, err := getProviderUpgrade(context.cloudType)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	result := make(map[string]modelCredential)
+	var distinct []rc.CloudCredentialDoc
+	byKey := make(map[string]*rc.CloudCredentialDoc)
+	names := make(map[string]bool)
+	add := func(doc *rc.CloudCredentialDoc) {
+		distinct = append(distinct, *doc)
+		names[doc.Owner+"/"+doc.Name] = true
+	}
+	if controller != nil {
+		add(controller)
+	}
+
+	controllerKey := ""
+	if provider.credential != nil {
+		authType, attributes, err := provider.credential(context.controllerModelSettings.Settings)
+		switch {
+		case err == nil:
+			controllerKey = secretsKey(authType, attributes)
+			byKey[localUserID(context.owner)+"\n"+controllerKey] = controller
+		case context.importedCredential != nil:
+			// The imported credential is there to replace missing or
+			// bad secrets, so there are none to match models against.
+			logger.Debugf("controller model has no usable credential: %v", err)
+		default:
+			return nil, nil, errors.Annotatef(err, "%s credential", context.cloudType)
+		}
+	}
+
+	var model b7.ModelDoc
+	iter := context.db.GetCollection(modelsC).Find(nil).Sort("_id").Iter()
+	defer iter.Close()
+	for iter.Next(&model) {
+		owner := localUserID(model.Owner)
+		chosen := modelCredential{
+			modelUUID:  model.UUID,
+			modelName:  model.Name,
+			owner:      owner,
+			credential: controller,
+		}
+		if provider.credential == nil {
+			chosen.fromController = true
+			result[model.UUID] = chosen
+			continue
+		}
+		settings, err := modelSettings(context.db, model.UUID)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		authType, attributes, err := provider.credential(settings)
+		if err != nil {
+			logger.Debugf("model %q has no credential of its own: %v", model.UUID, err)
+			chosen.fromController = true
+			result[model.UUID] = chosen
+			continue
+		}
+		key := secretsKey(authType, attributes)
+		if controllerKey != "" && key == controllerKey && controller != nil {
+			authType, attributes = controller.AuthType, controller.Attributes
+		}
+		if doc, found := byKey[owner+"\n"+key]; found {
+			chosen.credential = doc
+			result[model.UUID] = chosen
+			continue
+		}
+
+		doc := &rc.CloudCredentialDoc{
+			Owner:      owner,
+			Cloud:      context.cloud,
+			Name:       context.cloud,
+			AuthType:   authType,
+			Attributes: attributes,
+		}
+		for i := 2; names[doc.Owner+"/"+doc.Name]; i++ {
+			doc.Name = fmt.Sprintf("%s-%d", context.cloud, i)
+		}
+		add(doc)
+		byKey[owner+"\n"+key] = doc
+		chosen.credential = doc
+		result[model.UUID] = chosen
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, errors.Annotate(err, "reading models")
+	}
+	return result, distinct, nil
+}
+
+// secretsKey returns a string that is the same for credentials with the
+// same auth type and attributes.
+func secretsKey(authType string, attributes map[string]string) string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{authType}
+	for _, key := range keys {
+		parts = append(parts, key+"="+attributes[key])
+	}
+	return strings.Join(parts, "\n")
+}
+
+// reportModelCredentials shows which credential each model will use.
+func reportModelCredentials(context *dbUpgradeContext, credentials map[string]modelCredential) {
+	uuids := make([]string, 0, len(credentials))
+	for uuid := range credentials {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	context.Info("Model credentials:")
+	for _, uuid := range uuids {
+		chosen := credentials[uuid]
+		switch {
+		case chosen.credential == nil:
+			context.Info(fmt.Sprintf("  %s (%s, owner %s): no credential", chosen.modelName, uuid, chosen.owner))
+		case chosen.fromController:
+			context.Info(fmt.Sprintf("  %s (%s, owner %s): %s, from the controller", chosen.modelName, uuid, chosen.owner, credentialName(*chosen.credential)))
+		default:
+			context.Info(fmt.Sprintf("  %s (%s, owner %s): %s", chosen.modelName, uuid, chosen.owner, credentialName(*chosen.credential)))
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/howbazaar/b7-upgrade/b7"
 	"github.com/howbazaar/b7-upgrade/rc"
 	"github.com/juju/cmd"
@@ -18,27 +20,45 @@ import (
 	"github.com/juju/juju/state/stateenvirons"
 )
 
+// defaultBatchSize keeps transactions well under the 16MB document limit,
+// even for the larger documents like settings.
+const defaultBatchSize = 1000
+
 type Model struct {
-	Name       string
-	UUID       string
-	Controller bool
-	Machines   []Machine
+	Name       string    `json:"name" yaml:"name"`
+	UUID       string    `json:"uuid" yaml:"uuid"`
+	Controller bool      `json:"controller" yaml:"controller"`
+	Machines   []Machine `json:"machines" yaml:"machines"`
 }
 
 type Machine struct {
-	ID      string
-	Address string
+	ID      string `json:"id" yaml:"id"`
+	Address string `json:"address" yaml:"address"`
 }
 
 type FlatMachine struct {
-	Model   string
-	ID      string
-	Address string
+	Model   string `json:"model" yaml:"model"`
+	ID      string `json:"id" yaml:"id"`
+	Address string `json:"address" yaml:"address"`
 }
 
 type database struct {
 	session *mgo.Session
 	jujuDB  *mgo.Database
+
+	// step is the name of the upgrade step being run, if any.
+	step string
+	// sim, if set, has the dry-run transactions applied to it.
+	sim *simulator
+	// plan, if set, captures the dry-run transactions.
+	plan *planWriter
+	// batchSize is the most ops RunGroups puts in one transaction.
+	batchSize int
+	// undo is true if live transactions for a step should save the
+	// documents they change to the undo log first.
+	undo bool
+	// auditLog, if set, has every write recorded in it.
+	auditLog *auditLog
 }
 
 func NewDatabase() (_ *database, err error) {
@@ -56,8 +76,9 @@ func NewDatabase() (_ *database, err error) {
 	jujuDB := session.DB("juju")
 
 	db := &database{
-		session: session,
-		jujuDB:  jujuDB,
+		session:   session,
+		jujuDB:    jujuDB,
+		batchSize: defaultBatchSize,
 	}
 	return db, nil
 }
@@ -100,16 +121,34 @@ func (db *database) GetCollection(name string) *mgo.Collection {
 	return db.jujuDB.C(name)
 }
 
-func (db *database) TransactionRunner(ctx *cmd.Context, live bool) jujutxn.Runner {
+// docExists returns true if the document exists. In a dry-run it takes
+// account of the transactions simulated so far.
+func (db *database) docExists(collection string, id interface{}) (bool, error) {
+	if db.sim != nil {
+		doc, err := db.sim.get(collection, id)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		return doc.exists, nil
+	}
+	count, err := db.GetCollection(collection).FindId(id).Count()
+	if err != nil {
+		return false, errors.Annotatef(err, "reading %s %v", collection, id)
+	}
+	return count > 0, nil
+}
+
+func (db *database) TransactionRunner(ctx *cmd.Context, live bool) *liveRunner {
 	params := jujutxn.RunnerParams{Database: db.jujuDB}
 	runner := jujutxn.NewRunner(params)
-	return &liveRunner{ctx: ctx, live: live, runner: runner}
+	return &liveRunner{ctx: ctx, db: db, live: live, runner: runner}
 }
 
 type liveRunner struct {
 	jujutxn.Runner
 
 	ctx    *cmd.Context
+	db     *database
 	live   bool
 	runner jujutxn.Runner
 }
@@ -121,13 +160,117 @@ func (r *liveRunner) ResumeTransactions() error {
 // Only supports the RunTransaction method, all others panic.
 func (r *liveRunner) RunTransaction(ops []txn.Op) error {
 	logger.Debugf("RunTransaction: \n%# v", pretty.Formatter(ops))
+	err := r.runTransaction(ops)
+	for _, op := range ops {
+		r.db.audit(txnOpAuditEntry(op, r.live), err)
+	}
+	return err
+}
+
+func (r *liveRunner) runTransaction(ops []txn.Op) error {
 	if r.live {
+		var undoIDs []bson.ObjectId
+		if r.db.undo && r.db.step != "" {
+			var err error
+			if undoIDs, err = saveUndo(r.db, r.db.step, ops); err != nil {
+				return errors.Trace(err)
+			}
+		}
 		err := r.runner.RunTransaction(ops)
+		if err == txn.ErrAborted {
+			// Nothing was changed, so nothing needs undoing. Other
+			// errors may leave the transaction to be completed later,
+			// so the undo entries are kept.
+			discardUndo(r.db, undoIDs)
+			err = r.explainAbort(ops)
+		}
 		if err != nil {
 			logger.Errorf("RunTransaction: %s", err)
 		}
 		return err
 	}
+	if r.db.plan != nil {
+		if err := r.db.plan.addTxn(r.db.step, ops); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if r.db.sim != nil {
+		return errors.Trace(r.db.sim.apply(r.db.step, ops))
+	}
+	return nil
+}
+
+// explainAbort checks the assertions of the ops against the database, to
+// find which of them made the transaction abort.
+func (r *liveRunner) explainAbort(ops []txn.Op) error {
+	sim := newSimulator(r.db.jujuDB)
+	var problems []string
+	for i, op := range ops {
+		problem, err := sim.checkAssert(i, op)
+		if err != nil {
+			logger.Errorf("checking assertions of aborted transaction: %v", err)
+			return txn.ErrAborted
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) == 0 {
+		return errors.Annotate(txn.ErrAborted, "all assertions hold now, something else may have changed the documents")
+	}
+	return errors.Annotatef(txn.ErrAborted, "%d of %d ops failed their assertions:\n  %s",
+		len(problems), len(ops), strings.Join(problems, "\n  "))
+}
+
+// opGroups collects the ops for a step. The ops in each group must be run
+// in the same transaction, like the remove and insert that move a document
+// to a new id, but different groups can go in different transactions.
+type opGroups [][]txn.Op
+
+func (g *opGroups) add(ops ...txn.Op) {
+	*g = append(*g, ops)
+}
+
+func (g opGroups) count() int {
+	count := 0
+	for _, group := range g {
+		count += len(group)
+	}
+	return count
+}
+
+// batches splits the groups into batches of at most size ops. A group is
+// never split, so one bigger than size gets a batch of its own.
+func (g opGroups) batches(size int) [][]txn.Op {
+	var result [][]txn.Op
+	var batch []txn.Op
+	for _, group := range g {
+		if len(batch) > 0 && len(batch)+len(group) > size {
+			result = append(result, batch)
+			batch = nil
+		}
+		batch = append(batch, group...)
+	}
+	if len(batch) > 0 {
+		result = append(result, batch)
+	}
+	return result
+}
+
+// RunGroups runs the ops in batches, each in its own transaction, so that
+// no transaction gets too big to write or resume.
+func (r *liveRunner) RunGroups(groups opGroups) error {
+	label := r.db.step
+	if label == "" {
+		label = "transaction"
+	}
+	batches := groups.batches(r.db.batchSize)
+	for i, batch := range batches {
+		r.ctx.Infof("%s: batch %d of %d, %d ops", label, i+1, len(batches), len(batch))
+		if err := r.RunTransaction(batch); err != nil {
+			return errors.Annotatef(err, "batch %d of %d", i+1, len(batches))
+		}
+	}
 	return nil
 }
 
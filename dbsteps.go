@@ -0,0 +1,323 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/utils/set"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// dbUpgradeStep is a named step of upgrade-db. Steps can be run on their own
+// with --only, or left out with --skip.
+type dbUpgradeStep struct {
+	name        string
+	description string
+	run         func(*dbUpgradeContext) error
+	// applied returns true if the step has already been applied, and
+	// so can be skipped. Steps without it are always run.
+	applied func(*dbUpgradeContext) (bool, error)
+	// direct is true for steps that write outside of transactions, so
+	// can't be captured in a plan.
+	direct bool
+}
+
+// dbUpgradeSteps are all the steps run by upgrade-db, in the order they
+// need to be run. The names are used on the command line, so don't change
+// them.
+var dbUpgradeSteps = []dbUpgradeStep{{
+	name:        "clean-txn-queue",
+	description: "Repair the controller txn-queue and complete pending transactions",
+	run:         cleanTxnQueue,
+	direct:      true,
+}, {
+	name:        "drop-indices",
+	description: "Drop all non-id indices, they are recreated by add-tools",
+	run:         dropIndices,
+	direct:      true,
+}, {
+	name:        "update-controller",
+	description: "Add controller settings, cloud, credentials and controller users",
+	run:         updateController,
+	applied:     updateControllerApplied,
+}, {
+	name:        "write-lxd-certs",
+	description: "Write the LXD certs from the controller model settings to /etc/juju",
+	run:         writeLXDCerts,
+	applied:     lxdCertsApplied,
+	direct:      true,
+}, {
+	name:        "update-models",
+	description: "Add cloud and controller details to models, and remove old model settings",
+	run:         updateModels,
+	applied:     noDocsMatch(modelsC, oldModelsQuery),
+}, {
+	name:        "move-services",
+	description: "Move services to applications, with storage constraints and refcounts",
+	run:         moveDocsFromServicesToApplications,
+	applied:     noDocsMatch(serviceC, nil),
+}, {
+	name:        "update-units",
+	description: "Rename unit service field to application, add workload version status",
+	run:         updateUnits,
+	applied:     noDocsMatch(unitC, oldUnitsQuery),
+}, {
+	name:        "update-sequences",
+	description: "Rename service sequences to application sequences",
+	run:         updateSequences,
+	applied:     noDocsMatch(sequenceC, oldSequencesQuery),
+}, {
+	name:        "update-leases",
+	description: "Move service-leadership leases to application-leadership",
+	run:         updateLeases,
+	applied:     noDocsMatch(leasesC, oldLeasesQuery),
+}, {
+	name:        "update-model-entity-refs",
+	description: "Rename modelEntityRefs services to applications",
+	run:         updateModelEntityRefs,
+	applied:     noDocsMatch(modelEntityRefsC, oldModelEntityRefsQuery),
+}, {
+	name:        "update-relations",
+	description: "Rename relation endpoint servicename to applicationname",
+	run:         updateRelations,
+	applied:     noDocsMatch(relationsC, oldRelationsQuery),
+}, {
+	name:        "update-resources",
+	description: "Rename resources service-id to application-id",
+	run:         updateResources,
+	applied:     noDocsMatch(resourcesC, oldResourcesQuery),
+}, {
+	name:        "update-annotations",
+	description: "Change annotation service global keys to application global keys",
+	run: func(context *dbUpgradeContext) error {
+		return updateCollectionIDGlobalKey(context, annotationC, "globalkey")
+	},
+	applied: noDocsMatch(annotationC, oldGlobalKeyIDQuery),
+}, {
+	name:        "update-constraints",
+	description: "Change constraints service global keys to application global keys",
+	run: func(context *dbUpgradeContext) error {
+		return updateCollectionIDGlobalKey(context, constraintsC, "")
+	},
+	applied: noDocsMatch(constraintsC, oldGlobalKeyIDQuery),
+}, {
+	name:        "update-endpoint-bindings",
+	description: "Change endpoint binding service global keys to application global keys",
+	run: func(context *dbUpgradeContext) error {
+		return updateCollectionIDGlobalKey(context, endpointbindingsC, "")
+	},
+	applied: noDocsMatch(endpointbindingsC, oldGlobalKeyIDQuery),
+}, {
+	name:        "update-settings",
+	description: "Change settings service global keys to application global keys",
+	run: func(context *dbUpgradeContext) error {
+		return updateCollectionIDGlobalKey(context, settingsC, "")
+	},
+	applied: noDocsMatch(settingsC, oldGlobalKeyIDQuery),
+}, {
+	name:        "update-statuses",
+	description: "Change status service global keys to application global keys",
+	run: func(context *dbUpgradeContext) error {
+		return updateCollectionIDGlobalKey(context, statusesC, "")
+	},
+	applied: noDocsMatch(statusesC, oldGlobalKeyIDQuery),
+}, {
+	name:        "update-status-history",
+	description: "Change status history service global keys to application global keys",
+	run:         updateStatusHistoryCollection,
+	applied:     noDocsMatch(statusHistoryC, oldStatusHistoryQuery),
+	direct:      true,
+}, {
+	name:        "drop-old-collections",
+	description: "Drop the services, settingsrefs and ipaddresses collections",
+	run:         dropOldCollections,
+	applied:     oldCollectionsDropped,
+	direct:      true,
+}, {
+	name:        "upgrade-charms",
+	description: "Set life on charms",
+	run:         upgradeCharms,
+	applied:     noDocsMatch(charmsC, oldCharmsQuery),
+}, {
+	name:        "upgrade-users",
+	description: "Remove deactivated from users",
+	run:         upgradeUsersCollection,
+	applied:     noDocsMatch(usersC, oldUsersQuery),
+}, {
+	name:        "upgrade-model-users",
+	description: "Add object-uuid to model users and move their access to permissions",
+	run:         upgradeModelUsersCollection,
+	applied:     noDocsMatch(modelusersC, oldModelUsersQuery),
+}, {
+	name:        "upgrade-machines",
+	description: "Remove lxc from machine supported containers",
+	run:         upgradeMachinesCollection,
+	applied:     noDocsMatch(machinesC, oldMachinesQuery),
+}, {
+	name:        "upgrade-cloud-image-metadata",
+	description: "Make cloud image metadata global",
+	run:         upgradeCloudImageMetadata,
+	applied:     noDocsMatch(cloudimagemetadataC, oldCloudImageMetadataQuery),
+}, {
+	name:        "upgrade-spaces",
+	description: "Strip model uuid from space provider ids, add providerIDs docs",
+	run:         upgradeSpaces,
+	applied:     providerIDsApplied(spacesC),
+}, {
+	name:        "upgrade-subnets",
+	description: "Strip model uuid from subnet provider ids, add providerIDs docs",
+	run:         upgradeSubnets,
+	applied:     providerIDsApplied(subnetsC),
+}, {
+	name:        "upgrade-link-layer-devices",
+	description: "Strip model uuid from link layer device provider ids, add providerIDs docs",
+	run:         upgradeLinkLayerDevices,
+	applied:     providerIDsApplied(linklayerdevicesC),
+}, {
+	name:        "upgrade-ip-addresses",
+	description: "Strip model uuid from ip address provider ids, add providerIDs docs",
+	run:         upgradeIPAddresses,
+	applied:     providerIDsApplied(ipAddressesC),
+}, {
+	name:        "update-agent-tools",
+	description: "Set the tools version of machines and units to 2.0.0",
+	run:         updateAgentTools,
+	applied:     agentToolsApplied,
+}, {
+	name:        "add-tools",
+	description: "Reopen the database with state to recreate indices, and add the 2.0 tools",
+	run:         addTwoZeroBinaries,
+	direct:      true,
+}}
+
+// noDocsMatch returns an applied check that is true when no documents in
+// the collection match the query.
+func noDocsMatch(collection string, query interface{}) func(*dbUpgradeContext) (bool, error) {
+	return func(context *dbUpgradeContext) (bool, error) {
+		count, err := context.db.GetCollection(collection).Find(query).Count()
+		if err != nil {
+			return false, errors.Annotatef(err, "counting %s", collection)
+		}
+		return count == 0, nil
+	}
+}
+
+func updateControllerApplied(context *dbUpgradeContext) (bool, error) {
+	count, err := context.db.GetCollection(controllersC).FindId("controllerSettings").Count()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return count > 0, nil
+}
+
+func lxdCertsApplied(context *dbUpgradeContext) (bool, error) {
+	if context.cloudType != "lxd" {
+		return true, nil
+	}
+	for _, filename := range lxdCertFilenames {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	return true, nil
+}
+
+func oldCollectionsDropped(context *dbUpgradeContext) (bool, error) {
+	collections, err := context.db.Collections()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return !collections.Contains(serviceC) &&
+		!collections.Contains(settingsrefsC) &&
+		!collections.Contains("ipaddresses"), nil
+}
+
+// providerIDsApplied returns an applied check that is true when none of
+// the provider ids in the collection are prefixed with the model uuid.
+func providerIDsApplied(collection string) func(*dbUpgradeContext) (bool, error) {
+	return func(context *dbUpgradeContext) (bool, error) {
+		var doc bson.D
+		iter := context.db.GetCollection(collection).Find(nil).Iter()
+		defer iter.Close()
+		for iter.Next(&doc) {
+			modelUUID := getStringField(doc, "model-uuid")
+			if strings.HasPrefix(getStringField(doc, "providerid"), modelUUID) {
+				return false, nil
+			}
+		}
+		return true, errors.Annotatef(iter.Err(), "reading %s", collection)
+	}
+}
+
+func agentToolsApplied(context *dbUpgradeContext) (bool, error) {
+	for _, collection := range []string{machinesC, unitC} {
+		applied, err := noDocsMatch(collection, oldAgentToolsQuery)(context)
+		if err != nil || !applied {
+			return false, errors.Trace(err)
+		}
+	}
+	return true, nil
+}
+
+// selectDBUpgradeSteps returns the steps to run given the comma separated
+// names from --only and --skip.
+func selectDBUpgradeSteps(only, skip string) ([]dbUpgradeStep, error) {
+	if only != "" && skip != "" {
+		return nil, errors.New("--only and --skip can't be used together")
+	}
+	known := set.NewStrings()
+	for _, step := range dbUpgradeSteps {
+		known.Add(step.name)
+	}
+	parse := func(value string) (set.Strings, error) {
+		names := set.NewStrings()
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !known.Contains(name) {
+				return nil, errors.Errorf("unknown step %q, see list-steps", name)
+			}
+			names.Add(name)
+		}
+		return names, nil
+	}
+	onlyNames, err := parse(only)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	skipNames, err := parse(skip)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var result []dbUpgradeStep
+	for _, step := range dbUpgradeSteps {
+		if skipNames.Contains(step.name) {
+			continue
+		}
+		if !onlyNames.IsEmpty() && !onlyNames.Contains(step.name) {
+			continue
+		}
+		result = append(result, step)
+	}
+	return result, nil
+}
+
+func (c *upgrade) listSteps(ctx *cmd.Context) error {
+	if len(c.args) > 0 {
+		return errors.Errorf("unexpected args: %v", c.args)
+	}
+	var result []stepInfo
+	for _, step := range dbUpgradeSteps {
+		result = append(result, stepInfo{Name: step.name, Description: step.description})
+		ctx.Infof("%-29s %s", step.name, step.description)
+	}
+	c.setResult(result)
+	return nil
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// simulator applies the transactions of a dry-run to in-memory copies of
+// the documents they touch, so the changes a live run would make can be
+// shown without writing anything.
+type simulator struct {
+	db      *mgo.Database
+	docs    map[string]*simDoc
+	touched map[string]bool
+
+	diffs     []*docDiff
+	diffIndex map[string]*docDiff
+
+	aborts []predictedAbort
+}
+
+// predictedAbort is a dry-run transaction that would abort if run live.
+type predictedAbort struct {
+	step     string
+	ops      int
+	problems []string
+}
+
+type simDoc struct {
+	exists bool
+	doc    bson.M
+}
+
+// docDiff is the change one step makes to one document.
+type docDiff struct {
+	Step       string        `json:"step"`
+	Collection string        `json:"collection"`
+	ID         interface{}   `json:"id"`
+	Action     string        `json:"action"`
+	Changes    []fieldChange `json:"changes,omitempty"`
+
+	before simDoc
+	after  simDoc
+}
+
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+// ignoredDiffFields are maintained by the txn package, and would only add
+// noise to the diffs.
+var ignoredDiffFields = map[string]bool{
+	"txn-queue": true,
+	"txn-revno": true,
+}
+
+func newSimulator(db *mgo.Database) *simulator {
+	return &simulator{
+		db:        db,
+		docs:      make(map[string]*simDoc),
+		touched:   make(map[string]bool),
+		diffIndex: make(map[string]*docDiff),
+	}
+}
+
+func simKey(collection string, id interface{}) string {
+	return fmt.Sprintf("%s\x00%#v", collection, id)
+}
+
+// get returns the simulated state of the document, reading it from the
+// database the first time it is asked for.
+func (s *simulator) get(collection string, id interface{}) (*simDoc, error) {
+	key := simKey(collection, id)
+	if doc, found := s.docs[key]; found {
+		return doc, nil
+	}
+	doc := &simDoc{}
+	var raw bson.M
+	err := s.db.C(collection).FindId(id).One(&raw)
+	switch err {
+	case nil:
+		doc.exists = true
+		doc.doc = normalizeDoc(raw)
+	case mgo.ErrNotFound:
+	default:
+		return nil, errors.Annotatef(err, "reading %s %v", collection, id)
+	}
+	s.docs[key] = doc
+	return doc, nil
+}
+
+// apply simulates the ops being run as a transaction for the given step.
+// As with txn, an insert of an existing document or an update of a missing
+// one does nothing. If any assertion would fail, none of the ops are
+// applied and the transaction is noted as one that would abort.
+func (s *simulator) apply(step string, ops []txn.Op) error {
+	problems, err := s.checkAsserts(ops)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(problems) > 0 {
+		s.aborts = append(s.aborts, predictedAbort{step: step, ops: len(ops), problems: problems})
+		return nil
+	}
+
+	for _, op := range ops {
+		current, err := s.get(op.C, op.Id)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		before := current.copy()
+
+		switch {
+		case op.Insert != nil:
+			if !current.exists {
+				doc, err := toBSONM(op.Insert)
+				if err != nil {
+					return errors.Annotatef(err, "insert into %s %v", op.C, op.Id)
+				}
+				doc["_id"] = normalizeValue(op.Id)
+				current.exists = true
+				current.doc = doc
+			}
+		case op.Remove:
+			current.exists = false
+			current.doc = nil
+		case op.Update != nil:
+			if current.exists {
+				if err := applyUpdate(current.doc, op.Update); err != nil {
+					return errors.Annotatef(err, "update of %s %v", op.C, op.Id)
+				}
+			}
+		}
+
+		s.touched[simKey(op.C, op.Id)] = true
+		s.record(step, op.C, op.Id, before, current.copy())
+	}
+	return nil
+}
+
+// checkAsserts returns a description of each op that would make the
+// transaction abort, judged by the simulated state of the documents before
+// the transaction. Two ops on the same document are also reported, as the
+// upgrade steps never mean to do that.
+func (s *simulator) checkAsserts(ops []txn.Op) ([]string, error) {
+	var problems []string
+	first := make(map[string]int)
+	for i, op := range ops {
+		key := simKey(op.C, op.Id)
+		if j, found := first[key]; found {
+			problems = append(problems, fmt.Sprintf("op %d: %s %v: same document as op %d", i, op.C, op.Id, j))
+			continue
+		}
+		first[key] = i
+
+		problem, err := s.checkAssert(i, op)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems, nil
+}
+
+// checkAssert returns a description of the problem if the assertion of the
+// op does not hold, or "" if it does.
+func (s *simulator) checkAssert(i int, op txn.Op) (string, error) {
+	if op.Assert == nil {
+		return "", nil
+	}
+	current, err := s.get(op.C, op.Id)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	switch op.Assert {
+	case txn.DocExists:
+		if !current.exists {
+			return fmt.Sprintf("op %d: %s %v: asserts exists, but is missing", i, op.C, op.Id), nil
+		}
+	case txn.DocMissing:
+		if current.exists {
+			return fmt.Sprintf("op %d: %s %v: asserts missing, but exists", i, op.C, op.Id), nil
+		}
+	default:
+		ok, err := s.checkQueryAssert(op)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if !ok {
+			return fmt.Sprintf("op %d: %s %v: assertion %v does not hold", i, op.C, op.Id, op.Assert), nil
+		}
+	}
+	return "", nil
+}
+
+// checkQueryAssert checks an assertion that is a query. Only the database
+// can evaluate these, so if an earlier dry-run op changed the document the
+// assertion is assumed to hold.
+func (s *simulator) checkQueryAssert(op txn.Op) (bool, error) {
+	if s.touched[simKey(op.C, op.Id)] {
+		logger.Debugf("cannot check assertion on simulated %s %v", op.C, op.Id)
+		return true, nil
+	}
+	count, err := s.db.C(op.C).Find(bson.D{
+		{"_id", op.Id},
+		{"$and", []interface{}{op.Assert}},
+	}).Count()
+	if err != nil {
+		return false, errors.Annotatef(err, "checking assertion on %s %v", op.C, op.Id)
+	}
+	return count > 0, nil
+}
+
+// record notes the state of a document before and after an op. Several
+// ops from the same step on the same document give one diff from the state
+// before the first op to the state after the last.
+func (s *simulator) record(step, collection string, id interface{}, before, after simDoc) {
+	key := step + "\x00" + simKey(collection, id)
+	diff, found := s.diffIndex[key]
+	if !found {
+		diff = &docDiff{
+			Step:       step,
+			Collection: collection,
+			ID:         normalizeValue(id),
+			before:     before,
+		}
+		s.diffIndex[key] = diff
+		s.diffs = append(s.diffs, diff)
+	}
+	diff.after = after
+}
+
+func (d simDoc) copy() simDoc {
+	if !d.exists {
+		return simDoc{}
+	}
+	return simDoc{exists: true, doc: copyValue(d.doc).(bson.M)}
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		result := make(bson.M, len(v))
+		for key, item := range v {
+			result[key] = copyValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = copyValue(item)
+		}
+		return result
+	}
+	return value
+}
+
+// toBSONM round trips the value through bson so that structs and typed
+// slices look the same as documents read from the database.
+func toBSONM(value interface{}) (bson.M, error) {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return normalizeDoc(doc), nil
+}
+
+func normalizeDoc(doc bson.M) bson.M {
+	return normalizeValue(doc).(bson.M)
+}
+
+// normalizeValue converts all the nested documents to bson.M.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		result := make(bson.M, len(v))
+		for _, elem := range v {
+			result[elem.Name] = normalizeValue(elem.Value)
+		}
+		return result
+	case bson.M:
+		result := make(bson.M, len(v))
+		for key, item := range v {
+			result[key] = normalizeValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		return normalizeValue(bson.M(v))
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalizeValue(item)
+		}
+		return result
+	}
+	return value
+}
+
+// applyUpdate applies the $set and $unset operators of an update to the
+// document. No other operators are used by the upgrade steps.
+func applyUpdate(doc bson.M, update interface{}) error {
+	operators, err := toBSONM(bson.M{"u": update})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	updates, ok := operators["u"].(bson.M)
+	if !ok {
+		return errors.Errorf("unexpected update %v", update)
+	}
+	for operator, fields := range updates {
+		fieldsDoc, ok := fields.(bson.M)
+		if !ok {
+			return errors.Errorf("unexpected %s value %v", operator, fields)
+		}
+		for path, value := range fieldsDoc {
+			switch operator {
+			case "$set":
+				err = setPath(doc, path, value)
+			case "$unset":
+				err = unsetPath(doc, path)
+			default:
+				err = errors.Errorf("unsupported update operator %q", operator)
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
+
+// setPath sets the value at the dotted path, creating any missing parent
+// documents along the way. Numeric path elements index into arrays.
+func setPath(doc bson.M, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	var current interface{} = doc
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch v := current.(type) {
+		case bson.M:
+			if last {
+				v[part] = value
+				return nil
+			}
+			child, found := v[part]
+			if !found || child == nil {
+				child = bson.M{}
+				v[part] = child
+			}
+			current = child
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return errors.Errorf("cannot set %q, bad array index %q", path, part)
+			}
+			if last {
+				v[index] = value
+				return nil
+			}
+			current = v[index]
+		default:
+			return errors.Errorf("cannot set %q, %q is not a document", path, strings.Join(parts[:i], "."))
+		}
+	}
+	return nil
+}
+
+// unsetPath removes the value at the dotted path. As with mongo, unsetting
+// an array element sets it to null, and a missing path is not an error.
+func unsetPath(doc bson.M, path string) error {
+	parts := strings.Split(path, ".")
+	var current interface{} = doc
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch v := current.(type) {
+		case bson.M:
+			if last {
+				delete(v, part)
+				return nil
+			}
+			current = v[part]
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil
+			}
+			if last {
+				v[index] = nil
+				return nil
+			}
+			current = v[index]
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// flatten returns the leaf values of the document keyed by dotted path.
+func flatten(prefix string, value interface{}, result map[string]interface{}) {
+	switch v := value.(type) {
+	case bson.M:
+		if len(v) == 0 && prefix != "" {
+			result[prefix] = v
+		}
+		for key, item := range v {
+			if prefix == "" && ignoredDiffFields[key] {
+				continue
+			}
+			flatten(joinPath(prefix, key), item, result)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			result[prefix] = v
+		}
+		for i, item := range v {
+			flatten(joinPath(prefix, strconv.Itoa(i)), item, result)
+		}
+	default:
+		result[prefix] = value
+	}
+}
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// changes returns the document changes made so far, with the field changes
+// filled in. Documents that ended up as they started are left out.
+func (s *simulator) changes() []*docDiff {
+	var result []*docDiff
+	for _, diff := range s.diffs {
+		switch {
+		case !diff.before.exists && !diff.after.exists:
+			continue
+		case !diff.before.exists:
+			diff.Action = "insert"
+		case !diff.after.exists:
+			diff.Action = "remove"
+		default:
+			diff.Action = "update"
+		}
+
+		oldFields := make(map[string]interface{})
+		newFields := make(map[string]interface{})
+		if diff.before.exists {
+			flatten("", diff.before.doc, oldFields)
+		}
+		if diff.after.exists {
+			flatten("", diff.after.doc, newFields)
+		}
+		paths := make(map[string]bool)
+		for path := range oldFields {
+			paths[path] = true
+		}
+		for path := range newFields {
+			paths[path] = true
+		}
+		diff.Changes = nil
+		for path := range paths {
+			oldValue, hadOld := oldFields[path]
+			newValue, hasNew := newFields[path]
+			if hadOld && hasNew && fmt.Sprintf("%#v", oldValue) == fmt.Sprintf("%#v", newValue) {
+				continue
+			}
+			diff.Changes = append(diff.Changes, fieldChange{Field: path, Old: oldValue, New: newValue})
+		}
+		if len(diff.Changes) == 0 {
+			continue
+		}
+		sort.Sort(fieldChanges(diff.Changes))
+		result = append(result, diff)
+	}
+	return result
+}
+
+type fieldChanges []fieldChange
+
+func (f fieldChanges) Len() int           { return len(f) }
+func (f fieldChanges) Less(i, j int) bool { return f[i].Field < f[j].Field }
+func (f fieldChanges) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// groupDiffs orders the diffs by step, in the order the steps were run,
+// then by collection.
+func groupDiffs(diffs []*docDiff) []*docDiff {
+	stepOrder := make(map[string]int)
+	for _, diff := range diffs {
+		if _, found := stepOrder[diff.Step]; !found {
+			stepOrder[diff.Step] = len(stepOrder)
+		}
+	}
+	result := append([]*docDiff(nil), diffs...)
+	sort.Stable(byStepAndCollection{result, stepOrder})
+	return result
+}
+
+type byStepAndCollection struct {
+	diffs     []*docDiff
+	stepOrder map[string]int
+}
+
+func (b byStepAndCollection) Len() int      { return len(b.diffs) }
+func (b byStepAndCollection) Swap(i, j int) { b.diffs[i], b.diffs[j] = b.diffs[j], b.diffs[i] }
+func (b byStepAndCollection) Less(i, j int) bool {
+	left, right := b.diffs[i], b.diffs[j]
+	if left.Step != right.Step {
+		return b.stepOrder[left.Step] < b.stepOrder[right.Step]
+	}
+	return left.Collection < right.Collection
+}
+
+// writeDiffText writes the diffs in a form meant for reading.
+func writeDiffText(w io.Writer, diffs []*docDiff) {
+	var step, collection string
+	for _, diff := range groupDiffs(diffs) {
+		if diff.Step != step {
+			fmt.Fprintf(w, "\n=== %s ===\n", diff.Step)
+			step, collection = diff.Step, ""
+		}
+		if diff.Collection != collection {
+			fmt.Fprintf(w, "--- %s\n", diff.Collection)
+			collection = diff.Collection
+		}
+		fmt.Fprintf(w, "%s %v\n", diff.Action, diff.ID)
+		for _, change := range diff.Changes {
+			switch {
+			case change.Old == nil:
+				fmt.Fprintf(w, "  + %s: %s\n", change.Field, formatDiffValue(change.New))
+			case change.New == nil:
+				fmt.Fprintf(w, "  - %s: %s\n", change.Field, formatDiffValue(change.Old))
+			default:
+				fmt.Fprintf(w, "  ~ %s: %s -> %s\n", change.Field, formatDiffValue(change.Old), formatDiffValue(change.New))
+			}
+		}
+	}
+}
+
+func formatDiffValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case bson.ObjectId:
+		return v.Hex()
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// writeAborts lists the transactions that would abort, and the ops that
+// would cause it.
+func writeAborts(w io.Writer, aborts []predictedAbort) {
+	for _, abort := range aborts {
+		fmt.Fprintf(w, "%s: transaction of %d ops would abort:\n", abort.step, abort.ops)
+		for _, problem := range abort.problems {
+			fmt.Fprintf(w, "  %s\n", problem)
+		}
+	}
+}
+
+// writeDiffJSON writes the diffs to the named file as JSON.
+func writeDiffJSON(path string, diffs []*docDiff) error {
+	data, err := json.MarshalIndent(groupDiffs(diffs), "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotate(ioutil.WriteFile(path, data, 0644), "writing diff")
+}
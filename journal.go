@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/utils/set"
+	"gopkg.in/juju/names.v2"
+	goyaml "gopkg.in/yaml.v2"
+
+	"github.com/howbazaar/b7-upgrade/agent"
+)
+
+const (
+	phaseVerifyDB        = "verify-db"
+	phaseStopAgents      = "stop-agents"
+	phaseUpgradeDB       = "upgrade-db"
+	phaseUpgradeAgents   = "upgrade-agents"
+	phaseStartController = "start-controller"
+	phaseStartOthers     = "start-others"
+
+	eventStarted    = "started"
+	eventCompleted  = "completed"
+	eventFailed     = "failed"
+	eventRolledBack = "rolled-back"
+
+	journalFilename = "b7-upgrade-journal.yaml"
+)
+
+// upgradePhases are the phases of the upgrade process described in
+// the README, in the order they need to be run.
+var upgradePhases = []string{
+	phaseVerifyDB,
+	phaseStopAgents,
+	phaseUpgradeDB,
+	phaseUpgradeAgents,
+	phaseStartController,
+	phaseStartOthers,
+}
+
+func isUpgradePhase(name string) bool {
+	for _, phase := range upgradePhases {
+		if phase == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRunPhases are the phases that make no changes unless --live is
+// specified. Dry-runs of these phases are not recorded in the journal.
+var dryRunPhases = set.NewStrings(phaseUpgradeDB, phaseUpgradeAgents)
+
+type journalEntry struct {
+	Time  time.Time `yaml:"time" json:"time"`
+	Phase string    `yaml:"phase" json:"phase"`
+	Event string    `yaml:"event" json:"event"`
+	Host  string    `yaml:"host,omitempty" json:"host,omitempty"`
+	Error string    `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// journal records the start, completion and outcome of each upgrade
+// phase so that an interrupted upgrade can be picked up by someone else.
+type journal struct {
+	path    string
+	Entries []journalEntry `yaml:"entries"`
+}
+
+// journalPath returns the location of the journal, which lives next to
+// the agent config of the controller machine.
+func journalPath() string {
+	return filepath.Join(agent.Dir("/var/lib/juju", names.NewMachineTag("0")), journalFilename)
+}
+
+// readJournal reads the journal at path. A missing file is treated as
+// an empty journal.
+func readJournal(path string) (*journal, error) {
+	j := &journal{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, errors.Annotate(err, "reading upgrade journal")
+	}
+	if err := goyaml.Unmarshal(data, j); err != nil {
+		return nil, errors.Annotatef(err, "parsing upgrade journal %q", path)
+	}
+	return j, nil
+}
+
+// write replaces the journal file, going through a temporary file so a
+// crash part way through never leaves a truncated journal behind.
+func (j *journal) write() error {
+	data, err := goyaml.Marshal(j)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Annotate(err, "writing upgrade journal")
+	}
+	return errors.Annotate(os.Rename(tmp, j.path), "writing upgrade journal")
+}
+
+// record adds an entry for the phase to the journal and writes it out.
+func (j *journal) record(phase, event string, phaseErr error) error {
+	entry := journalEntry{
+		Time:  time.Now().UTC(),
+		Phase: phase,
+		Event: event,
+	}
+	entry.Host, _ = os.Hostname()
+	if phaseErr != nil {
+		entry.Error = phaseErr.Error()
+	}
+	j.Entries = append(j.Entries, entry)
+	return errors.Trace(j.write())
+}
+
+// last returns the most recent entry for the phase, if there is one.
+func (j *journal) last(phase string) (journalEntry, bool) {
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		if j.Entries[i].Phase == phase {
+			return j.Entries[i], true
+		}
+	}
+	return journalEntry{}, false
+}
+
+// rollBack records that the phase has been rolled back, or that it failed
+// if the rollback had an error. Every later phase that has been started is
+// marked as rolled back, as they need to be run again once the phase has
+// been. The caller must make sure that is true before calling rollBack.
+func (j *journal) rollBack(phase string, phaseErr error) error {
+	later := false
+	for _, name := range upgradePhases {
+		if name == phase {
+			later = true
+			continue
+		}
+		if !later {
+			continue
+		}
+		if _, found := j.last(name); !found {
+			continue
+		}
+		if err := j.record(name, eventRolledBack, nil); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	event := eventRolledBack
+	if phaseErr != nil {
+		event = eventFailed
+	}
+	return errors.Trace(j.record(phase, event, phaseErr))
+}
+
+// checkCanRun returns an error if any phase before the given one has not
+// completed, or if any phase after it has already been started and not
+// rolled back.
+func (j *journal) checkCanRun(phase string) error {
+	before := true
+	for _, name := range upgradePhases {
+		if name == phase {
+			before = false
+			continue
+		}
+		entry, found := j.last(name)
+		if before && (!found || entry.Event != eventCompleted) {
+			return errors.Errorf("cannot run %q, %q has not completed (see %s)", phase, name, j.path)
+		}
+		if !before && found && entry.Event != eventRolledBack {
+			return errors.Errorf("cannot run %q, %q has already been %s (see %s)", phase, name, entry.Event, j.path)
+		}
+	}
+	return nil
+}
+
+// next returns the first phase that has not completed.
+func (j *journal) next() string {
+	for _, name := range upgradePhases {
+		if entry, found := j.last(name); !found || entry.Event != eventCompleted {
+			return name
+		}
+	}
+	return ""
+}
+
+// phase wraps the action for an upgrade phase so its progress is recorded
+// in the journal.
+func (c *upgrade) phase(phase string, action func(*cmd.Context) error) func(*cmd.Context) error {
+	return func(ctx *cmd.Context) error {
+		return c.runPhase(ctx, phase, action)
+	}
+}
+
+// runPhase checks that the phase is the next one to run, then runs the
+// action, recording the start and outcome in the journal.
+func (c *upgrade) runPhase(ctx *cmd.Context, phase string, action func(*cmd.Context) error) error {
+	if dryRunPhases.Contains(phase) && !c.live {
+		return action(ctx)
+	}
+
+	j, err := readJournal(journalPath())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := j.checkCanRun(phase); err != nil {
+		return errors.Trace(err)
+	}
+	if err := j.record(phase, eventStarted, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	actionErr := action(ctx)
+	event := eventCompleted
+	if actionErr != nil {
+		event = eventFailed
+	}
+	if err := j.record(phase, event, actionErr); err != nil {
+		if actionErr != nil {
+			logger.Errorf("recording failure of %q: %v", phase, err)
+			return actionErr
+		}
+		return errors.Trace(err)
+	}
+	return actionErr
+}
+
+// progress shows where the upgrade is up to, according to the journal.
+func (c *upgrade) progress(ctx *cmd.Context) error {
+	if len(c.args) > 0 {
+		return errors.Errorf("unexpected args: %v", c.args)
+	}
+
+	j, err := readJournal(journalPath())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c.setResult(progressResult{Journal: j.path, Next: j.next(), Entries: j.Entries})
+
+	ctx.Infof("Journal: %s\n", j.path)
+	for _, name := range upgradePhases {
+		entry, found := j.last(name)
+		switch {
+		case !found:
+			ctx.Infof("  %-17s not started", name)
+		case entry.Event == eventStarted:
+			ctx.Infof("  %-17s started %s, not finished", name, entry.Time.Format(time.RFC3339))
+		default:
+			ctx.Infof("  %-17s %s %s", name, entry.Event, entry.Time.Format(time.RFC3339))
+		}
+	}
+
+	if next := j.next(); next != "" {
+		ctx.Infof("\nNext phase: %s", next)
+	} else {
+		ctx.Infof("\nAll phases completed.")
+	}
+
+	if len(j.Entries) > 0 {
+		ctx.Infof("\nHistory:")
+		for _, entry := range j.Entries {
+			ctx.Infof("  %s %s %s on %s", entry.Time.Format(time.RFC3339), entry.Phase, entry.Event, entry.Host)
+			if entry.Error != "" {
+				ctx.Infof("    ERROR: %s", entry.Error)
+			}
+		}
+	}
+	return nil
+}
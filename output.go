@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/juju/errors"
+	goyaml "gopkg.in/yaml.v2"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+// actionOutput is written to stdout when --format is json or yaml.
+type actionOutput struct {
+	Action string      `json:"action" yaml:"action"`
+	Live   bool        `json:"live" yaml:"live"`
+	Error  string      `json:"error,omitempty" yaml:"error,omitempty"`
+	Result interface{} `json:"result,omitempty" yaml:"result,omitempty"`
+}
+
+// machineResult is a DistResult with the error as a string, so it can
+// be written out.
+type machineResult struct {
+	Model     string `json:"model" yaml:"model"`
+	MachineID string `json:"machine-id" yaml:"machine-id"`
+	Error     string `json:"error,omitempty" yaml:"error,omitempty"`
+	Code      int    `json:"code" yaml:"code"`
+	Stdout    string `json:"stdout,omitempty" yaml:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty" yaml:"stderr,omitempty"`
+}
+
+func machineResults(results []DistResult) []machineResult {
+	output := make([]machineResult, len(results))
+	for i, result := range results {
+		output[i] = machineResult{
+			Model:     result.Model,
+			MachineID: result.MachineID,
+			Code:      result.Code,
+			Stdout:    result.Stdout,
+			Stderr:    result.Stderr,
+		}
+		if result.Error != nil {
+			output[i].Error = result.Error.Error()
+		}
+	}
+	return output
+}
+
+type verifyDBResult struct {
+	Server FlatMachine `json:"server" yaml:"server"`
+	Models []Model     `json:"models" yaml:"models"`
+}
+
+type stepOutcome struct {
+	Step    string   `json:"step" yaml:"step"`
+	Outcome string   `json:"outcome" yaml:"outcome"`
+	Error   string   `json:"error,omitempty" yaml:"error,omitempty"`
+	Notes   []string `json:"notes,omitempty" yaml:"notes,omitempty"`
+}
+
+type stepInfo struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description" yaml:"description"`
+}
+
+type checkResult struct {
+	Collection  string   `json:"collection" yaml:"collection"`
+	Description string   `json:"description" yaml:"description"`
+	Passed      bool     `json:"passed" yaml:"passed"`
+	Offending   []string `json:"offending,omitempty" yaml:"offending,omitempty"`
+}
+
+type progressResult struct {
+	Journal string         `json:"journal" yaml:"journal"`
+	Next    string         `json:"next,omitempty" yaml:"next,omitempty"`
+	Entries []journalEntry `json:"entries" yaml:"entries"`
+}
+
+type cleanDBResult struct {
+	Removed int `json:"removed" yaml:"removed"`
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case formatText, formatJSON, formatYAML:
+		return true
+	}
+	return false
+}
+
+// setResult keeps the result of the action, to be written out in the
+// format asked for when the action finishes. It is ignored for text
+// output, as text actions print as they go.
+func (c *upgrade) setResult(result interface{}) {
+	c.result = result
+}
+
+// writeOutput writes the action result, along with any error, to stdout
+// in the format asked for.
+func (c *upgrade) writeOutput(stdout io.Writer, actionErr error) error {
+	if c.format == formatText {
+		return nil
+	}
+	output := actionOutput{
+		Action: c.actionName,
+		Live:   c.live,
+		Result: c.result,
+	}
+	if actionErr != nil {
+		output.Error = actionErr.Error()
+	}
+
+	var data []byte
+	var err error
+	switch c.format {
+	case formatJSON:
+		data, err = json.MarshalIndent(output, "", "  ")
+		data = append(data, '\n')
+	case formatYAML:
+		data, err = goyaml.Marshal(output)
+	}
+	if err != nil {
+		return errors.Annotatef(err, "writing %s output", c.format)
+	}
+	_, err = stdout.Write(data)
+	return errors.Trace(err)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// A plan file is a stream of BSON documents: a planHeader followed by a
+// planRecord for each transaction, or for each step that writes outside
+// of transactions, in the order they are to be run.
+type planHeader struct {
+	Created        time.Time `bson:"created"`
+	ControllerUUID string    `bson:"controller-uuid"`
+	ToolsFilename  string    `bson:"tools"`
+}
+
+type planRecord struct {
+	Step string `bson:"step"`
+	// Direct is true for steps that write outside of transactions.
+	// These can't be captured, so apply-plan runs the step again.
+	Direct bool     `bson:"direct,omitempty"`
+	Ops    []txn.Op `bson:"ops,omitempty"`
+	// Revnos are the txn-revno values of the documents that are touched
+	// for the first time by this transaction.
+	Revnos []planRevno `bson:"revnos,omitempty"`
+}
+
+type planRevno struct {
+	C      string      `bson:"c"`
+	Id     interface{} `bson:"id"`
+	Exists bool        `bson:"exists"`
+	Revno  int64       `bson:"revno"`
+}
+
+// planWriter captures the transactions of an upgrade-db dry-run.
+type planWriter struct {
+	db   *mgo.Database
+	path string
+	file *os.File
+	out  *bufio.Writer
+	seen map[string]bool
+
+	txns int
+}
+
+func createPlan(path string, db *mgo.Database, header planHeader) (*planWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Annotate(err, "creating plan")
+	}
+	plan := &planWriter{
+		db:   db,
+		path: path,
+		file: file,
+		out:  bufio.NewWriter(file),
+		seen: make(map[string]bool),
+	}
+	if err := plan.write(header); err != nil {
+		file.Close()
+		return nil, errors.Trace(err)
+	}
+	return plan, nil
+}
+
+func (p *planWriter) write(doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = p.out.Write(data)
+	return errors.Annotate(err, "writing plan")
+}
+
+// addTxn records the ops, along with the current txn-revno of each
+// document not seen in an earlier transaction.
+func (p *planWriter) addTxn(step string, ops []txn.Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	record := planRecord{Step: step, Ops: ops}
+	for _, op := range ops {
+		key := simKey(op.C, op.Id)
+		if p.seen[key] {
+			continue
+		}
+		p.seen[key] = true
+		revno, err := readRevno(p.db, op.C, op.Id)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		record.Revnos = append(record.Revnos, revno)
+	}
+	p.txns++
+	return errors.Trace(p.write(record))
+}
+
+// addDirectStep records that the step writes outside of transactions.
+func (p *planWriter) addDirectStep(step string) error {
+	return errors.Trace(p.write(planRecord{Step: step, Direct: true}))
+}
+
+// close flushes the plan and returns the checksum of the file, so the
+// plan that was reviewed can be matched with the plan that is applied.
+func (p *planWriter) close() (string, error) {
+	err := p.out.Flush()
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Annotate(err, "writing plan")
+	}
+	sum, err := readBackupDocs(p.path, nil)
+	return sum, errors.Trace(err)
+}
+
+func readRevno(db *mgo.Database, collection string, id interface{}) (planRevno, error) {
+	result := planRevno{C: collection, Id: id}
+	var doc struct {
+		Revno int64 `bson:"txn-revno"`
+	}
+	err := db.C(collection).FindId(id).Select(bson.M{"txn-revno": 1}).One(&doc)
+	switch err {
+	case nil:
+		result.Exists = true
+		result.Revno = doc.Revno
+	case mgo.ErrNotFound:
+	default:
+		return result, errors.Annotatef(err, "reading txn-revno of %s %v", collection, id)
+	}
+	return result, nil
+}
+
+// readPlan reads the plan file, returning its checksum along with the
+// contents.
+func readPlan(path string) (planHeader, []planRecord, string, error) {
+	var header planHeader
+	var records []planRecord
+	first := true
+	sum, err := readBackupDocs(path, func(data []byte) error {
+		if first {
+			first = false
+			return errors.Annotate(bson.Unmarshal(data, &header), "reading plan header")
+		}
+		var record planRecord
+		if err := bson.Unmarshal(data, &record); err != nil {
+			return errors.Annotate(err, "reading plan")
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return header, nil, "", errors.Trace(err)
+	}
+	if first {
+		return header, nil, "", errors.Errorf("plan %q is empty", path)
+	}
+	return header, records, sum, nil
+}
+
+// checkPlanRevnos returns an error listing every document that has changed
+// since the plan was made.
+func checkPlanRevnos(db *mgo.Database, records []planRecord) error {
+	var changed []string
+	for _, record := range records {
+		for _, expected := range record.Revnos {
+			actual, err := readRevno(db, expected.C, expected.Id)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			switch {
+			case expected.Exists != actual.Exists:
+				changed = append(changed, fmt.Sprintf("%s %v: existed %v, now %v", expected.C, expected.Id, expected.Exists, actual.Exists))
+			case expected.Revno != actual.Revno:
+				changed = append(changed, fmt.Sprintf("%s %v: txn-revno was %d, now %d", expected.C, expected.Id, expected.Revno, actual.Revno))
+			}
+		}
+	}
+	if len(changed) > 0 {
+		return errors.Errorf("%d documents changed since the plan was made:\n  %s", len(changed), strings.Join(changed, "\n  "))
+	}
+	return nil
+}
+
+// applyPlan replays a plan written by an upgrade-db dry-run with --plan.
+// Nothing is applied if any document has changed since the plan was made,
+// and each transaction is checked again just before it is run, as the
+// direct steps may change documents. Without --live the plan is only
+// checked.
+func (c *upgrade) applyPlan(ctx *cmd.Context) error {
+	if len(c.args) == 0 {
+		return errors.Errorf("missing path to plan file")
+	}
+	if len(c.args) > 1 {
+		return errors.Errorf("unexpected args: %v", c.args[1:])
+	}
+	header, records, sum, err := readPlan(c.args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ctx.Infof("Plan %s, sha256 %s", c.args[0], sum)
+	ctx.Infof("Created %s, controller UUID %s, %d records",
+		header.Created.Format(time.RFC3339), header.ControllerUUID, len(records))
+
+	if c.live {
+		if err := checkRecentBackup(c.backupDir); err != nil {
+			return errors.Annotate(err, "apply-plan --live needs a recent verified backup")
+		}
+	}
+
+	steps := make(map[string]dbUpgradeStep)
+	for _, step := range dbUpgradeSteps {
+		steps[step.name] = step
+	}
+	for _, record := range records {
+		if _, found := steps[record.Step]; !found {
+			return errors.Errorf("plan has unknown step %q", record.Step)
+		}
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+	db.undo = c.live
+	db.auditLog = c.audit
+
+	if err := checkPlanRevnos(db.jujuDB, records); err != nil {
+		return errors.Trace(err)
+	}
+	ctx.Infof("No planned documents have changed")
+	if !c.live {
+		return nil
+	}
+
+	context := &dbUpgradeContext{
+		cmdCtx:        ctx,
+		db:            db,
+		live:          c.live,
+		toolsFilename: header.ToolsFilename,
+	}
+	if err := upgradePrecheck(context); err != nil {
+		return err
+	}
+	if err := prepareContext(context); err != nil {
+		return errors.Trace(err)
+	}
+	context.controllerUUID, err = chooseControllerUUID(context, header.ControllerUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	runner := db.TransactionRunner(ctx, c.live)
+	for i, record := range records {
+		db.step = record.Step
+		if record.Direct {
+			ctx.Infof("Running %s", record.Step)
+			if err := steps[record.Step].run(context); err != nil {
+				return errors.Annotatef(err, "step %q", record.Step)
+			}
+			continue
+		}
+		// Direct steps and earlier records run after the check above, so
+		// check the documents this record is first to touch again now.
+		if err := checkPlanRevnos(db.jujuDB, records[i:i+1]); err != nil {
+			return errors.Annotatef(err, "step %q", record.Step)
+		}
+		ctx.Infof("Applying %s transaction, %d ops (%d of %d)", record.Step, len(record.Ops), i+1, len(records))
+		if err := runner.RunTransaction(record.Ops); err != nil {
+			return errors.Annotatef(err, "step %q", record.Step)
+		}
+	}
+	db.step = ""
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+	"github.com/juju/utils/set"
+)
+
+const rollbackScript = `
+cd /var/lib/juju/agents
+for agent in *
+do
+    if [ -f $agent/agent.conf.old ]; then
+        echo $agent: restore agent.conf from agent.conf.old
+        do-op cp $agent/agent.conf.old $agent/agent.conf
+    else
+        echo $agent: no agent.conf.old, agent.conf not changed
+    fi
+
+    current=$(readlink /var/lib/juju/tools/$agent || true)
+    if [ ! -f $agent/tools.old ]; then
+        echo $agent: no tools.old, tools symlink not changed
+    elif [ "$current" = "$(cat $agent/tools.old)" ]; then
+        echo $agent: tools symlink already points to $current
+    else
+        echo $agent: tools symlink $current reverted to $(cat $agent/tools.old)
+        do-op ln -sfn $(cat $agent/tools.old) /var/lib/juju/tools/$agent
+    fi
+done
+`
+
+// stopAgentsScript stops every agent on a machine, failing if any of them
+// is still running afterwards.
+const stopAgentsScript = `
+cd /var/lib/juju/agents
+for agent in *
+do
+    sudo service jujud-$agent stop || true
+    if sudo service jujud-$agent status 2>/dev/null | grep -q running; then
+        echo jujud-$agent is still running
+        exit 1
+    fi
+done
+`
+
+// activeStartPhases returns the start phases the journal shows as started
+// and not rolled back, as their agents may be running.
+func activeStartPhases(j *journal) []string {
+	var active []string
+	for _, phase := range []string{phaseStartController, phaseStartOthers} {
+		if entry, found := j.last(phase); found && entry.Event != eventRolledBack {
+			active = append(active, phase)
+		}
+	}
+	return active
+}
+
+// stopAllAgents stops the agents on every machine, returning an error if
+// any machine could not be reached or still has an agent running.
+func stopAllAgents(ctx *cmd.Context) error {
+	machines, err := getAllMachines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var failed []string
+	for _, result := range parallelCall(machines, "set -eu\n"+stopAgentsScript) {
+		if result.Error != nil || result.Code != 0 {
+			failed = append(failed, result.Model+" "+result.MachineID)
+			ctx.Infof("%s %s: agents not stopped: %v %s", result.Model, result.MachineID, result.Error, strings.TrimSpace(result.Stdout))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("agents not stopped on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// rollbackAgents undoes upgradeAgents on every machine, or just those with
+// the given addresses. Each agent.conf is restored from the agent.conf.old
+// that CopyToolsToMachine left behind, and the tools symlinks are pointed
+// back at the targets it recorded in tools.old. Any agents that were
+// started are stopped first.
+func (c *upgrade) rollbackAgents(ctx *cmd.Context, args []string) error {
+	addresses := set.NewStrings(args...)
+
+	j, err := readJournal(journalPath())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if entry, found := j.last(phaseStopAgents); !found || entry.Event != eventCompleted {
+		return errors.Errorf("cannot roll back, %q has not completed (see %s)", phaseStopAgents, j.path)
+	}
+	// Once an agent has been started it is running the 2.0 jujud, so
+	// every agent is stopped before the journal can show the start
+	// phases as rolled back.
+	if active := activeStartPhases(j); len(active) > 0 {
+		ctx.Infof("%s started, stopping the agents on every machine", strings.Join(active, " and "))
+		if c.live {
+			if err := stopAllAgents(ctx); err != nil {
+				return errors.Annotate(err, "cannot roll back")
+			}
+		}
+	}
+
+	machines, err := getAllMachines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var selected []FlatMachine
+	for _, machine := range machines {
+		if addresses.IsEmpty() || addresses.Contains(machine.Address) {
+			selected = append(selected, machine)
+		}
+	}
+
+	var script string
+	if logger.LogLevel() == loggo.DEBUG {
+		script = "set -xeu\n"
+	} else {
+		script = "set -eu\n"
+	}
+	script += rollbackScript
+	if c.live {
+		script = strings.Replace(script, "do-op ", "", -1)
+	} else {
+		script = strings.Replace(script, "do-op ", "echo '  run: '", -1)
+	}
+
+	results := parallelCall(selected, script)
+	c.setResult(machineResults(results))
+
+	var rollbackErr error
+	for _, result := range results {
+		ctx.Infof("%s %s", result.Model, result.MachineID)
+		if result.Error != nil {
+			rollbackErr = errors.New("one or more machines had a problem")
+			ctx.Infof("  ERROR: %v", result.Error)
+		}
+		if result.Code != 0 {
+			rollbackErr = errors.New("one or more machines had a problem")
+			ctx.Infof("  Code: %d", result.Code)
+		}
+		if result.Stdout != "" {
+			out := strings.Join(strings.Split(strings.TrimSpace(result.Stdout), "\n"), "\n    ")
+			ctx.Infof("    %s", out)
+		}
+		if result.Stderr != "" {
+			logger.Debugf("%s/%s stderr: \n%s", result.Model, result.MachineID, result.Stderr)
+		}
+	}
+
+	if c.live {
+		// The agents need upgrading again before they can be started,
+		// so make the journal show that.
+		if err := j.rollBack(phaseUpgradeAgents, rollbackErr); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return rollbackErr
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+)
+
+type runAllStep struct {
+	phase  string
+	args   []string
+	action func(*cmd.Context) error
+	// dryRun is true if the phase can be usefully run without --live.
+	// Stopping and starting agents always happens, and upgrading the
+	// agents needs the controller UUID written by upgrade-db.
+	dryRun bool
+	// skipOnceStarted names a phase which, once the journal shows it
+	// has been started, means this step must not be run again.
+	skipOnceStarted string
+}
+
+// runAll runs each phase of the upgrade process in order, stopping at the
+// first failure. Unless --yes is given, confirmation is needed before moving
+// on to the next phase.
+func (c *upgrade) runAll(ctx *cmd.Context) error {
+	if len(c.args) == 0 {
+		return errors.Errorf("missing path to 2.0 tools file")
+	}
+	if len(c.args) > 1 {
+		return errors.Errorf("unexpected args: %v", c.args[1:])
+	}
+	toolsFilename := c.args[0]
+
+	steps := []runAllStep{
+		{phase: phaseVerifyDB, action: c.verifyDB, dryRun: true},
+		{phase: phaseStopAgents, action: c.stopAgents},
+		// A backup taken after upgrade-db has started would be partially
+		// upgraded, and would become the latest backup for restore-db.
+		{phase: "backup-db", action: c.backupDB, skipOnceStarted: phaseUpgradeDB},
+		{phase: phaseUpgradeDB, args: []string{toolsFilename}, action: c.upgradeDB, dryRun: true},
+		{phase: phaseUpgradeAgents, args: []string{toolsFilename}, action: c.upgradeAgents},
+		{phase: phaseStartController, action: c.startServer},
+		{phase: phaseStartOthers, action: c.startAgents},
+	}
+
+	j, err := readJournal(journalPath())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	outcomes := make(map[string]string)
+	defer func() {
+		c.setResult(runAllOutcomes(steps, outcomes))
+	}()
+	stdin := bufio.NewReader(ctx.Stdin)
+	for i, step := range steps {
+		if reason := step.skipReason(j, c.live); reason != "" {
+			outcomes[step.phase] = reason
+			continue
+		}
+
+		ctx.Infof("\n=== %s ===\n", step.phase)
+		c.args = step.args
+		action := step.action
+		if isUpgradePhase(step.phase) {
+			action = c.phase(step.phase, step.action)
+		}
+		if err := action(ctx); err != nil {
+			outcomes[step.phase] = "FAILED"
+			showRunAllSummary(ctx, steps, outcomes)
+			return errors.Annotatef(err, "%s failed", step.phase)
+		}
+		outcomes[step.phase] = "completed"
+		showRunAllSummary(ctx, steps, outcomes)
+
+		next := nextRunAllStep(steps[i+1:], j, c.live)
+		if next == "" || c.yes {
+			continue
+		}
+		ctx.Infof("Continue with %s? [y/N]", next)
+		answer, err := stdin.ReadString('\n')
+		if err != nil && answer == "" {
+			return errors.Annotate(err, "reading confirmation")
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return errors.Errorf("stopped before %s", next)
+		}
+	}
+	return nil
+}
+
+// skipReason returns why the step is not to be run, or "" if it is.
+// Completed phases are skipped in dry-runs too, as the journal would not
+// let them run again.
+func (step runAllStep) skipReason(j *journal, live bool) string {
+	if !live && !step.dryRun {
+		return "skipped in dry-run"
+	}
+	if entry, found := j.last(step.phase); found && entry.Event == eventCompleted {
+		return "already completed"
+	}
+	if _, found := j.last(step.skipOnceStarted); found {
+		return "skipped, " + step.skipOnceStarted + " already started"
+	}
+	return ""
+}
+
+// nextRunAllStep returns the name of the first of the remaining steps that
+// will actually be run.
+func nextRunAllStep(steps []runAllStep, j *journal, live bool) string {
+	for _, step := range steps {
+		if step.skipReason(j, live) == "" {
+			return step.phase
+		}
+	}
+	return ""
+}
+
+// runAllOutcomes returns the outcome of each step, in order.
+func runAllOutcomes(steps []runAllStep, outcomes map[string]string) []stepOutcome {
+	var result []stepOutcome
+	for _, step := range steps {
+		outcome, found := outcomes[step.phase]
+		if !found {
+			outcome = "pending"
+		}
+		result = append(result, stepOutcome{Step: step.phase, Outcome: outcome})
+	}
+	return result
+}
+
+func showRunAllSummary(ctx *cmd.Context, steps []runAllStep, outcomes map[string]string) {
+	ctx.Infof("\nSummary:")
+	for _, step := range steps {
+		outcome, found := outcomes[step.phase]
+		if !found {
+			outcome = "pending"
+		}
+		ctx.Infof("  %-17s %s", step.phase, outcome)
+	}
+	ctx.Infof("")
+}
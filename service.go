@@ -10,23 +10,27 @@ import (
 
 func (c *upgrade) agents(ctx *cmd.Context) error {
 	if len(c.args) == 0 {
-		return errors.Errorf("missing action: [status, stop, start-controller, start-others]")
+		return errors.Errorf("missing action: [status, stop, start-controller, start-others, rollback]")
 	}
-	if len(c.args) > 1 {
-		return errors.Errorf("unexpected args: %v", c.args[1:])
+	action, args := c.args[0], c.args[1:]
+	if action == "rollback" {
+		return c.rollbackAgents(ctx, args)
+	}
+	if len(args) > 0 {
+		return errors.Errorf("unexpected args: %v", args)
 	}
 
-	switch c.args[0] {
+	switch action {
 	case "stop":
-		return c.stopAgents(ctx)
+		return c.runPhase(ctx, phaseStopAgents, c.stopAgents)
 	case "start-controller":
-		return c.startServer(ctx)
+		return c.runPhase(ctx, phaseStartController, c.startServer)
 	case "start-others":
-		return c.startAgents(ctx)
+		return c.runPhase(ctx, phaseStartOthers, c.startAgents)
 	case "status":
 		return c.agentStatus(ctx)
 	default:
-		return errors.Errorf("unknown action: %q", c.args[0])
+		return errors.Errorf("unknown action: %q", action)
 	}
 	return nil
 }
@@ -37,7 +41,7 @@ func (c *upgrade) stopAgents(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 
-	return serviceCall(ctx, machines, "stop")
+	return c.serviceCall(ctx, machines, "stop")
 }
 
 func (c *upgrade) startServer(ctx *cmd.Context) error {
@@ -45,7 +49,7 @@ func (c *upgrade) startServer(ctx *cmd.Context) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	return serviceCall(ctx, []FlatMachine{server}, "start")
+	return c.serviceCall(ctx, []FlatMachine{server}, "start")
 }
 
 func (c *upgrade) startAgents(ctx *cmd.Context) error {
@@ -54,7 +58,7 @@ func (c *upgrade) startAgents(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 
-	return serviceCall(ctx, machines, "start")
+	return c.serviceCall(ctx, machines, "start")
 }
 
 func (c *upgrade) agentStatus(ctx *cmd.Context) error {
@@ -63,10 +67,10 @@ func (c *upgrade) agentStatus(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 
-	return serviceCall(ctx, machines, "status")
+	return c.serviceCall(ctx, machines, "status")
 }
 
-func serviceCall(ctx *cmd.Context, machines []FlatMachine, command string) error {
+func (c *upgrade) serviceCall(ctx *cmd.Context, machines []FlatMachine, command string) error {
 
 	script := fmt.Sprintf(`
 set -xu
@@ -78,6 +82,7 @@ done
 	`, command)
 
 	results := parallelCall(machines, script)
+	c.setResult(machineResults(results))
 
 	for _, result := range results {
 		ctx.Infof("%s %s", result.Model, result.MachineID)
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+const (
+	undoDatabase   = "b7upgrade"
+	undoCollection = "undo"
+
+	// undoLogName is how the undo log is named in the audit log.
+	undoLogName = undoDatabase + "." + undoCollection
+)
+
+// undoEntry is the state of a document before a live upgrade-db
+// transaction changed it.
+type undoEntry struct {
+	ID      bson.ObjectId `bson:"_id"`
+	Time    time.Time     `bson:"time"`
+	Step    string        `bson:"step"`
+	C       string        `bson:"c"`
+	DocID   interface{}   `bson:"doc-id"`
+	Existed bool          `bson:"existed"`
+	Doc     bson.D        `bson:"doc,omitempty"`
+}
+
+func (db *database) undoLog() *mgo.Collection {
+	return db.session.DB(undoDatabase).C(undoCollection)
+}
+
+// saveUndo saves the current state of every document the ops touch, and
+// returns the ids of the new undo entries.
+func saveUndo(db *database, step string, ops []txn.Op) ([]bson.ObjectId, error) {
+	var ids []bson.ObjectId
+	var entries []interface{}
+	seen := make(map[string]bool)
+	now := time.Now().UTC()
+	for _, op := range ops {
+		key := simKey(op.C, op.Id)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		entry := undoEntry{
+			ID:    bson.NewObjectId(),
+			Time:  now,
+			Step:  step,
+			C:     op.C,
+			DocID: op.Id,
+		}
+		err := db.GetCollection(op.C).FindId(op.Id).One(&entry.Doc)
+		switch err {
+		case nil:
+			entry.Existed = true
+		case mgo.ErrNotFound:
+		default:
+			return nil, errors.Annotatef(err, "reading %s %v for undo log", op.C, op.Id)
+		}
+		ids = append(ids, entry.ID)
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	err := db.undoLog().Insert(entries...)
+	for _, entry := range entries {
+		entry := entry.(undoEntry)
+		db.audit(auditEntry{
+			Live:       true,
+			Action:     "insert",
+			Collection: undoLogName,
+			ID:         entry.ID,
+			Detail:     bson.D{{"c", entry.C}, {"doc-id", entry.DocID}, {"existed", entry.Existed}},
+		}, err)
+	}
+	if err != nil {
+		return nil, errors.Annotate(err, "writing undo log")
+	}
+	return ids, nil
+}
+
+// discardUndo removes undo entries for a transaction that was not applied.
+func discardUndo(db *database, ids []bson.ObjectId) {
+	if len(ids) == 0 {
+		return
+	}
+	query := bson.D{{"_id", bson.D{{"$in", ids}}}}
+	_, err := db.undoLog().RemoveAll(query)
+	db.audit(auditEntry{Live: true, Action: "remove-all", Collection: undoLogName, Detail: query}, err)
+	if err != nil {
+		logger.Errorf("removing undo entries of aborted transaction: %v", err)
+	}
+}
+
+// undoOps returns the ops that put each document back as it was before the
+// step first changed it.
+func undoOps(db *database, entries []undoEntry) (opGroups, error) {
+	var ops opGroups
+	for _, entry := range entries {
+		var current bson.D
+		err := db.GetCollection(entry.C).FindId(entry.DocID).One(&current)
+		exists := true
+		if err == mgo.ErrNotFound {
+			exists = false
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "reading %s %v", entry.C, entry.DocID)
+		}
+
+		switch {
+		case !entry.Existed && exists:
+			ops.add(txn.Op{
+				C:      entry.C,
+				Id:     entry.DocID,
+				Assert: txn.DocExists,
+				Remove: true,
+			})
+		case entry.Existed && !exists:
+			ops.add(txn.Op{
+				C:      entry.C,
+				Id:     entry.DocID,
+				Assert: txn.DocMissing,
+				Insert: copyBsonDField(entry.Doc),
+			})
+		case entry.Existed && exists:
+			fields := copyBsonDField(entry.Doc)
+			var unset bson.D
+			for _, field := range copyBsonDField(current) {
+				if _, found := readBsonDField(fields, field.Name); !found {
+					unset = append(unset, bson.DocElem{field.Name, nil})
+				}
+			}
+			var update bson.D
+			if len(fields) > 0 {
+				update = append(update, bson.DocElem{"$set", fields})
+			}
+			if len(unset) > 0 {
+				update = append(update, bson.DocElem{"$unset", unset})
+			}
+			if len(update) == 0 {
+				continue
+			}
+			ops.add(txn.Op{
+				C:      entry.C,
+				Id:     entry.DocID,
+				Assert: txn.DocExists,
+				Update: update,
+			})
+		}
+	}
+	return ops, nil
+}
+
+// readUndoEntries returns the undo entries for the step, keeping only the
+// earliest for each document.
+func readUndoEntries(db *database, step string) ([]undoEntry, error) {
+	var all []undoEntry
+	if err := db.undoLog().Find(bson.D{{"step", step}}).Sort("_id").All(&all); err != nil {
+		return nil, errors.Annotate(err, "reading undo log")
+	}
+	var result []undoEntry
+	seen := make(map[string]bool)
+	for _, entry := range all {
+		key := simKey(entry.C, entry.DocID)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// undoDB reverses the transactions of one upgrade-db step, using the undo
+// log written when the step was run live. Changes made outside of
+// transactions, like dropped indices and collections, are not undone.
+func (c *upgrade) undoDB(ctx *cmd.Context) error {
+	if len(c.args) > 0 {
+		return errors.Errorf("unexpected args: %v", c.args)
+	}
+	if c.step == "" {
+		return errors.New("missing --step, see list-steps")
+	}
+	index := -1
+	for i, step := range dbUpgradeSteps {
+		if step.name == c.step {
+			index = i
+		}
+	}
+	if index < 0 {
+		return errors.Errorf("unknown step %q, see list-steps", c.step)
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+	db.auditLog = c.audit
+
+	// Undoing a step underneath later steps would leave the later
+	// changes built on documents that are no longer there.
+	for _, later := range dbUpgradeSteps[index+1:] {
+		count, err := db.undoLog().Find(bson.D{{"step", later.name}}).Count()
+		if err != nil {
+			return errors.Annotate(err, "reading undo log")
+		}
+		if count > 0 {
+			return errors.Errorf("%q was run after %q, undo it first", later.name, c.step)
+		}
+	}
+
+	entries, err := readUndoEntries(db, c.step)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(entries) == 0 {
+		return errors.Errorf("nothing to undo for %q", c.step)
+	}
+	ops, err := undoOps(db, entries)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, group := range ops {
+		for _, op := range group {
+			switch {
+			case op.Remove:
+				ctx.Verbosef("remove %s %v", op.C, op.Id)
+			case op.Insert != nil:
+				ctx.Verbosef("re-insert %s %v", op.C, op.Id)
+			default:
+				ctx.Verbosef("restore %s %v", op.C, op.Id)
+			}
+		}
+	}
+	ctx.Infof("Undo %s: %d documents saved, %d to put back", c.step, len(entries), ops.count())
+
+	db.step = fmt.Sprintf("undo %s", c.step)
+	runner := db.TransactionRunner(ctx, c.live)
+	if err := runner.RunGroups(ops); err != nil {
+		return errors.Trace(err)
+	}
+	if c.live {
+		query := bson.D{{"step", c.step}}
+		_, err := db.undoLog().RemoveAll(query)
+		db.audit(auditEntry{Live: true, Action: "remove-all", Collection: undoLogName, Detail: query}, err)
+		if err != nil {
+			return errors.Annotate(err, "clearing undo log")
+		}
+	}
+	return nil
+}
@@ -74,6 +74,12 @@ func (c *upgrade) upgradeAgents(ctx *cmd.Context) error {
 	ctx.Infof("Waiting for copies for finish")
 	wg.Wait()
 
+	distResults := make([]DistResult, len(results))
+	for i, result := range results {
+		distResults[i] = DistResult(result)
+	}
+	c.setResult(machineResults(distResults))
+
 	// Sort the results
 
 	for _, result := range results {
@@ -199,6 +205,12 @@ fi
 cd /var/lib/juju/agents
 for agent in *
 do
+    current=$(readlink /var/lib/juju/tools/$agent || true)
+    if [ -n "$current" ] && [ "$current" != "2.0.0-xenial-amd64" ]; then
+        echo Record tools symlink $current for $agent in $agent/tools.old
+        do-op sh -c "echo $current > $agent/tools.old"
+    fi
+
     echo Set tools symlink for $agent
 	do-op rm /var/lib/juju/tools/$agent
     do-op ln -s 2.0.0-xenial-amd64 /var/lib/juju/tools/$agent
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 	"github.com/juju/version"
 	"github.com/kr/pretty"
 	"gopkg.in/juju/names.v2"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/txn"
 
@@ -64,6 +66,7 @@ const (
 	statusHistoryC      = "statuseshistory"
 	storageconstraintsC = "storageconstraints"
 	subnetsC            = "subnets"
+	toolsmetadataC      = "toolsmetadata"
 	usermodelnameC      = "usermodelname"
 	unitC               = "units"
 	usersC              = "users"
@@ -74,6 +77,31 @@ var (
 	unescapeReplacer = strings.NewReplacer(fullWidthDot, ".", fullWidthDollar, "$")
 )
 
+// These queries match the documents that have not been upgraded yet. The
+// upgrade steps only look at matching documents, so a step that was
+// interrupted can be run again, and a step with no matching documents has
+// already been applied.
+var (
+	oldModelsQuery             = bson.D{{"server-uuid", bson.D{{"$exists", true}}}}
+	oldUnitsQuery              = bson.D{{"service", bson.D{{"$exists", true}}}}
+	oldSequencesQuery          = bson.D{{"name", bson.RegEx{Pattern: "^" + b7.ServiceTagKind + "-"}}}
+	oldLeasesQuery             = bson.D{{"namespace", "service-leadership"}}
+	oldModelEntityRefsQuery    = bson.D{{"services", bson.D{{"$exists", true}}}}
+	oldRelationsQuery          = bson.D{{"endpoints.servicename", bson.D{{"$exists", true}}}}
+	oldResourcesQuery          = bson.D{{"service-id", bson.D{{"$exists", true}}}}
+	oldGlobalKeyIDQuery        = bson.D{{"_id", bson.RegEx{Pattern: "^[^:]*:s#"}}}
+	oldStatusHistoryQuery      = bson.D{{"globalkey", bson.RegEx{Pattern: "^s#"}}}
+	oldCharmsQuery             = bson.D{{"life", bson.D{{"$exists", false}}}}
+	oldUsersQuery              = bson.D{{"deactivated", bson.D{{"$exists", true}}}}
+	oldModelUsersQuery         = bson.D{{"object-uuid", bson.D{{"$exists", false}}}}
+	oldMachinesQuery           = bson.D{{"supportedcontainers", "lxc"}}
+	oldCloudImageMetadataQuery = bson.D{{"model-uuid", bson.D{{"$exists", true}}}}
+	oldAgentToolsQuery         = bson.D{{"tools.version", bson.D{{"$ne", agentVersion}}}}
+)
+
+// This code assumes a homogeneous environment of xenial amd64 machines.
+const agentVersion = "2.0.0-xenial-amd64"
+
 type dbUpgradeContext struct {
 	cmdCtx             *cmd.Context
 	db                 *database
@@ -81,15 +109,31 @@ type dbUpgradeContext struct {
 	controllerUUID     string
 	controllerSettings map[string]interface{}
 
-	cloud      string
-	credential string
-	owner      string // admin@local
+	cloud     string
+	cloudType string
+	owner     string // the controller model owner
+
+	// importedCredential, if set, is used instead of the credential in
+	// the controller model settings.
+	importedCredential *importedCredential
+
+	controllerModelSettings b7.SettingsDoc
+	toolsFilename           string
+
+	// notes are things the current step wants to report, which go in
+	// its outcome.
+	notes []string
 }
 
 func (c *dbUpgradeContext) Info(args ...interface{}) {
 	fmt.Fprintln(c.cmdCtx.Stdout, args...)
 }
 
+// addNote adds a line to the outcome of the current step.
+func (c *dbUpgradeContext) addNote(note string) {
+	c.notes = append(c.notes, note)
+}
+
 func (c *upgrade) upgradeDB(ctx *cmd.Context) error {
 	// TODO: consider other non-juju databases
 	// logs, file and charm storage
@@ -101,6 +145,24 @@ func (c *upgrade) upgradeDB(ctx *cmd.Context) error {
 	}
 	toolsFilename := c.args[0]
 
+	if c.live {
+		if c.plan != "" {
+			return errors.New("--plan is only for dry-runs, use apply-plan to apply it")
+		}
+		if err := checkRecentBackup(c.backupDir); err != nil {
+			return errors.Annotate(err, "upgrade-db --live needs a recent verified backup")
+		}
+	}
+
+	if c.batchSize < 1 {
+		return errors.Errorf("--batch-size must be at least 1")
+	}
+
+	steps, err := selectDBUpgradeSteps(c.only, c.skip)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	// Try to read the agent config file.
 	// assuming machine-0 of controller
 	db, err := NewDatabase()
@@ -108,84 +170,120 @@ func (c *upgrade) upgradeDB(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 	defer db.Close()
+	db.batchSize = c.batchSize
+	db.undo = c.live
+	db.auditLog = c.audit
+	if !c.live {
+		db.sim = newSimulator(db.jujuDB)
+	}
 
-	// The first thing that should happen is to create a controller-uuid
-	// This needs to be stored both in the DB and the agent config.
 	context := &dbUpgradeContext{
-		cmdCtx:         ctx,
-		db:             db,
-		live:           c.live,
-		controllerUUID: utils.MustNewUUID().String(),
+		cmdCtx:        ctx,
+		db:            db,
+		live:          c.live,
+		toolsFilename: toolsFilename,
 	}
 
 	if err := upgradePrecheck(context); err != nil {
 		return err
 	}
 
-	if err := cleanTxnQueue(context); err != nil {
-		return err
-	}
-
-	// Drop all indices
-	ctx.Infof("Drop non-id indices early")
-	collections, err := db.Collections()
-	if err != nil {
+	if err := prepareContext(context); err != nil {
 		return errors.Trace(err)
 	}
-	for _, name := range collections.SortedValues() {
-		col := db.GetCollection(name)
-		indices, err := col.Indexes()
+
+	if c.credentials != "" {
+		credential, err := readCredentials(c.credentials, context.cloud, c.credentialName)
 		if err != nil {
-			return errors.Annotatef(err, "unable to get indices for %q", name)
+			return errors.Trace(err)
 		}
-		for _, idx := range indices {
-			if idx.Name == "_id_" {
-				continue
-			}
-			ctx.Infof("Drop index %s.%s", name, idx.Name)
-			if c.live {
-				col.DropIndexName(idx.Name)
-			}
+		if err := useImportedCredential(context, credential); err != nil {
+			return errors.Trace(err)
 		}
+		ctx.Infof("Using credential %q from %s", credential.name, c.credentials)
+	} else if c.credentialName != "" {
+		return errors.New("--credential-name needs --credentials")
 	}
 
-	ctx.Infof("Generated new controller UUID: %s", context.controllerUUID)
-
-	if err := updateController(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateModels(context); err != nil {
-		return errors.Trace(err)
-	}
-
-	if err := renameServiceToApplication(context); err != nil {
+	// The first thing that should happen is to create a controller-uuid
+	// This needs to be stored both in the DB and the agent config. If an
+	// earlier run got far enough to store one, it must be used again.
+	context.controllerUUID, err = chooseControllerUUID(context, c.controllerUUID)
+	if err != nil {
 		return errors.Trace(err)
 	}
 
-	if err := otherSchemaUpgrades(context); err != nil {
-		return errors.Trace(err)
+	if c.plan != "" {
+		db.plan, err = createPlan(c.plan, db.jujuDB, planHeader{
+			Created:        time.Now().UTC(),
+			ControllerUUID: context.controllerUUID,
+			ToolsFilename:  toolsFilename,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 
-	if err := updateAgentTools(context); err != nil {
-		return errors.Trace(err)
+	var outcomes []stepOutcome
+	defer func() {
+		c.setResult(outcomes)
+	}()
+	for _, step := range steps {
+		if step.applied != nil {
+			applied, err := step.applied(context)
+			if err != nil {
+				outcomes = append(outcomes, stepOutcome{Step: step.name, Outcome: "failed", Error: err.Error()})
+				return errors.Annotatef(err, "checking step %q", step.name)
+			}
+			if applied {
+				outcomes = append(outcomes, stepOutcome{Step: step.name, Outcome: "already applied"})
+				ctx.Infof("Skipping %s, already applied", step.name)
+				continue
+			}
+		}
+		db.step = step.name
+		context.notes = nil
+		if db.plan != nil && step.direct {
+			if err := db.plan.addDirectStep(step.name); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if err := step.run(context); err != nil {
+			outcomes = append(outcomes, stepOutcome{Step: step.name, Outcome: "failed", Error: err.Error(), Notes: context.notes})
+			return errors.Annotatef(err, "step %q", step.name)
+		}
+		outcome := "applied"
+		if !c.live {
+			outcome = "dry-run"
+		}
+		outcomes = append(outcomes, stepOutcome{Step: step.name, Outcome: outcome, Notes: context.notes})
 	}
+	db.step = ""
 
-	if !c.live {
-		ctx.Infof("skipping reopening db with state as that modifies lease clocks")
-		return nil
+	if db.plan != nil {
+		sum, err := db.plan.close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ctx.Infof("Wrote %d transactions to plan %s, sha256 %s", db.plan.txns, c.plan, sum)
 	}
 
-	// Re-open using state.Open in order to recreate indices
-	st, err := openDBusingState()
-	if err != nil {
-		return errors.Annotate(err, "reopening DB using state to recreate indices")
-	}
-	defer st.Close()
-	// Add the tools to the DB.
-	if err := addTwoZeroBinariesToDB(context, st, toolsFilename); err != nil {
-		return errors.Annotate(err, "adding 2.0 binaries to DB")
+	if db.sim != nil {
+		diffs := db.sim.changes()
+		if c.diff {
+			writeDiffText(ctx.Stdout, diffs)
+		}
+		if c.diffJSON != "" {
+			if err := writeDiffJSON(c.diffJSON, diffs); err != nil {
+				return errors.Trace(err)
+			}
+			ctx.Infof("Wrote %d document changes to %s", len(diffs), c.diffJSON)
+		}
+		if len(db.sim.aborts) > 0 {
+			writeAborts(ctx.Stdout, db.sim.aborts)
+			return errors.Errorf("%d transactions would abort if run live", len(db.sim.aborts))
+		}
 	}
-
 	return nil
 }
 
@@ -209,29 +307,101 @@ func upgradePrecheck(context *dbUpgradeContext) error {
 }
 
 func cleanTxnQueue(context *dbUpgradeContext) error {
-	if !context.live {
-		return nil
-	}
+	clearQueue := bson.D{{"$set", bson.D{{"txn-queue", []string{}}}}}
 
 	context.Info("Repair controller apiHostPorts txn-queue.")
-	if err := context.db.GetCollection(controllersC).UpdateId("apiHostPorts", bson.D{{"$set", bson.D{{"txn-queue", []string{}}}}}); err != nil {
+	var err error
+	if context.live {
+		err = context.db.GetCollection(controllersC).UpdateId("apiHostPorts", clearQueue)
+	}
+	context.db.audit(auditEntry{Live: context.live, Action: "update-id", Collection: controllersC, ID: "apiHostPorts", Detail: clearQueue}, err)
+	if err != nil {
 		return errors.Trace(err)
 	}
 
 	context.Info("Make sure any pending transactions are complete.")
-	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	if err := runner.ResumeTransactions(); err != nil {
+	if context.live {
+		runner := context.db.TransactionRunner(context.cmdCtx, context.live)
+		err = runner.ResumeTransactions()
+	}
+	context.db.audit(auditEntry{Live: context.live, Action: "resume-transactions"}, err)
+	if err != nil {
 		return errors.Trace(err)
 	}
 
 	context.Info("Clear out the txn-queue on the models.")
-	if _, err := context.db.GetCollection(modelsC).UpdateAll(nil, bson.D{{"$set", bson.D{{"txn-queue", []string{}}}}}); err != nil {
+	if context.live {
+		_, err = context.db.GetCollection(modelsC).UpdateAll(nil, clearQueue)
+	}
+	context.db.audit(auditEntry{Live: context.live, Action: "update-all", Collection: modelsC, Detail: clearQueue}, err)
+	if err != nil {
 		return errors.Trace(err)
 	}
 
 	return nil
 }
 
+// dropIndices drops all non-id indices early. They are recreated when the
+// database is reopened using state.
+func dropIndices(context *dbUpgradeContext) error {
+	context.cmdCtx.Infof("Drop non-id indices early")
+	collections, err := context.db.Collections()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, name := range collections.SortedValues() {
+		col := context.db.GetCollection(name)
+		indices, err := col.Indexes()
+		if err != nil {
+			return errors.Annotatef(err, "unable to get indices for %q", name)
+		}
+		for _, idx := range indices {
+			if idx.Name == "_id_" {
+				continue
+			}
+			context.cmdCtx.Infof("Drop index %s.%s", name, idx.Name)
+			var err error
+			if context.live {
+				// Failures are only recorded, add-tools recreates
+				// the indices anyway.
+				err = col.DropIndexName(idx.Name)
+			}
+			context.db.audit(auditEntry{Live: context.live, Action: "drop-index", Collection: name, Detail: idx.Name}, err)
+		}
+	}
+	return nil
+}
+
+// addTwoZeroBinaries reopens the database using state, which recreates
+// the indices, and adds the 2.0 tools to the tools storage.
+func addTwoZeroBinaries(context *dbUpgradeContext) error {
+	if !context.live {
+		context.cmdCtx.Infof("skipping reopening db with state as that modifies lease clocks")
+		return nil
+	}
+
+	// Re-open using state.Open in order to recreate indices
+	st, err := openDBusingState()
+	if err != nil {
+		return errors.Annotate(err, "reopening DB using state to recreate indices")
+	}
+	defer st.Close()
+
+	count, err := context.db.GetCollection(toolsmetadataC).FindId(agentVersion).Count()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if count > 0 {
+		context.Info("2.0 tools already added")
+		return nil
+	}
+	// Add the tools to the DB.
+	if err := addTwoZeroBinariesToDB(context, st, context.toolsFilename); err != nil {
+		return errors.Annotate(err, "adding 2.0 binaries to DB")
+	}
+	return nil
+}
+
 func addTwoZeroBinariesToDB(context *dbUpgradeContext, st *state.State, toolsFilename string) error {
 	storage, err := st.ToolsStorage()
 	if err != nil {
@@ -254,6 +424,7 @@ func addTwoZeroBinariesToDB(context *dbUpgradeContext, st *state.State, toolsFil
 	if context.live {
 		blobstore := context.db.session.DB("blobstore")
 		err := blobstore.C("blobstore.chunks").DropIndexName("files_id_1_n_1")
+		context.db.audit(auditEntry{Live: true, Action: "drop-index", Collection: "blobstore.blobstore.chunks", Detail: "files_id_1_n_1"}, err)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -290,20 +461,14 @@ func readAndHash(r io.Reader) (data []byte, sha256hex string, err error) {
 	return data, fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
 
-func updateController(context *dbUpgradeContext) error {
-	fmt.Fprintln(context.cmdCtx.Stdout, "Adding controller settings")
-	controllers := context.db.GetCollection(controllersC)
-	var doc bson.M
-	err := controllers.FindId("stateServingInfo").One(&doc)
-	if err != nil {
-		return errors.Annotate(err, "getting stateServingInfo")
-	}
-
+// prepareContext reads the controller model and its settings to work out
+// the cloud and owner used by the upgrade steps.
+func prepareContext(context *dbUpgradeContext) error {
 	modelUUID := context.db.ControllerModelUUID()
 	logger.Debugf("controller model-uuid: %s", modelUUID)
 
 	var controllerModel b7.ModelDoc
-	err = context.db.GetCollection(modelsC).FindId(modelUUID).One(&controllerModel)
+	err := context.db.GetCollection(modelsC).FindId(modelUUID).One(&controllerModel)
 	if err != nil {
 		return errors.Annotate(err, "getting controller model")
 	}
@@ -316,6 +481,93 @@ func updateController(context *dbUpgradeContext) error {
 
 	logger.Debugf("controllerSettings: %# v", pretty.Formatter(controllerSettings))
 
+	context.cloudType, _ = controllerSettings.Settings["type"].(string)
+	provider, err := getProviderUpgrade(context.cloudType)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	context.cloud = provider.name(context.cloudType)
+	context.owner = controllerModel.Owner
+	context.controllerModelSettings = controllerSettings
+	return nil
+}
+
+// storedControllerUUIDs returns the controller UUIDs already written by
+// an earlier run, mapped to where they were found.
+func storedControllerUUIDs(context *dbUpgradeContext) (map[string][]string, error) {
+	found := make(map[string][]string)
+
+	var settings rc.SettingsDoc
+	err := context.db.GetCollection(controllersC).FindId("controllerSettings").One(&settings)
+	if err == nil {
+		if uuid, _ := settings.Settings["controller-uuid"].(string); uuid != "" {
+			found[uuid] = append(found[uuid], "controllerSettings")
+		}
+	} else if err != mgo.ErrNotFound {
+		return nil, errors.Annotate(err, "reading controller settings")
+	}
+
+	var doc rc.ModelDoc
+	iter := context.db.GetCollection(modelsC).Find(nil).Iter()
+	defer iter.Close()
+	for iter.Next(&doc) {
+		if doc.ControllerUUID != "" {
+			found[doc.ControllerUUID] = append(found[doc.ControllerUUID], "model "+doc.UUID)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.Annotate(err, "reading models")
+	}
+	return found, nil
+}
+
+// chooseControllerUUID returns the controller UUID stored by an earlier
+// run, or the requested one, or a new one if neither exist. It is an error
+// for the stored values to disagree with each other or with the request.
+func chooseControllerUUID(context *dbUpgradeContext, requested string) (string, error) {
+	if requested != "" && !utils.IsValidUUIDString(requested) {
+		return "", errors.Errorf("invalid controller UUID %q", requested)
+	}
+
+	found, err := storedControllerUUIDs(context)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(found) > 1 {
+		var details []string
+		for uuid, sources := range found {
+			details = append(details, fmt.Sprintf("%s in %s", uuid, strings.Join(sources, ", ")))
+		}
+		sort.Strings(details)
+		return "", errors.Errorf("stored controller UUIDs disagree:\n  %s", strings.Join(details, "\n  "))
+	}
+	for uuid := range found {
+		if requested != "" && requested != uuid {
+			return "", errors.Errorf("requested controller UUID %s, but %s is already stored", requested, uuid)
+		}
+		context.cmdCtx.Infof("Reusing stored controller UUID: %s", uuid)
+		return uuid, nil
+	}
+	if requested != "" {
+		context.cmdCtx.Infof("Using requested controller UUID: %s", requested)
+		return requested, nil
+	}
+	uuid := utils.MustNewUUID().String()
+	context.cmdCtx.Infof("Generated new controller UUID: %s", uuid)
+	return uuid, nil
+}
+
+func updateController(context *dbUpgradeContext) error {
+	fmt.Fprintln(context.cmdCtx.Stdout, "Adding controller settings")
+	controllers := context.db.GetCollection(controllersC)
+	var doc bson.M
+	err := controllers.FindId("stateServingInfo").One(&doc)
+	if err != nil {
+		return errors.Annotate(err, "getting stateServingInfo")
+	}
+
+	controllerSettings := context.controllerModelSettings
+
 	// Also add in doc for controller settings.
 	settings := map[string]interface{}{
 		"api-port":                doc["apiport"],
@@ -326,42 +578,16 @@ func updateController(context *dbUpgradeContext) error {
 		"state-port":              doc["stateport"],
 	}
 
-	context.cloud = controllerSettings.Settings["type"].(string)
-	context.owner = controllerModel.Owner
-	credentialID := fmt.Sprintf("%s#%s#%s", context.cloud, context.owner, context.cloud)
-	context.credential = fmt.Sprintf("%s/%s/%s", context.cloud, context.owner, context.cloud)
-	cloud := rc.CloudDoc{
-		Name: context.cloud,
-		Type: context.cloud,
-	}
-	credentails := rc.CloudCredentialDoc{
-		Owner: context.owner,
-		Cloud: context.cloud,
-		Name:  context.cloud,
-	}
-	switch context.cloud {
-	case "lxd":
-		cloud.AuthTypes = []string{"empty"}
-		cloud.Regions = map[string]rc.CloudRegionSubdoc{
-			"localhost": rc.CloudRegionSubdoc{},
-		}
-		credentails.AuthType = "empty"
-		if err := writeLXDCerts(controllerSettings, context.live); err != nil {
-			return errors.Annotate(err, "failed to write out lxd certs")
-		}
-	case "maas":
-		cloud.AuthTypes = []string{"oauth1"}
-		cloud.Endpoint = controllerSettings.Settings["maas-server"].(string)
-		credentails.AuthType = "oauth1"
-		credentails.Attributes = map[string]string{
-			"maas-oauth": controllerSettings.Settings["maas-oauth"].(string),
-		}
-	default:
-		return errors.Errorf("unsupported type %q", context.cloud)
+	cloud, credentials, err := controllerCloud(context)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	err = runner.RunTransaction([]txn.Op{{
+	// The cloud, credentials and controller settings must go in together,
+	// so they are one group. It is run last: updateControllerApplied looks
+	// for the controller settings, so if an earlier batch fails the whole
+	// step is run again.
+	controllerOps := []txn.Op{{
 		C:      controllersC,
 		Id:     "e",
 		Assert: txn.DocExists,
@@ -371,59 +597,163 @@ func updateController(context *dbUpgradeContext) error {
 		Id:     context.cloud,
 		Assert: txn.DocMissing,
 		Insert: cloud,
-	}, {
-		C:      cloudCredentialsC,
-		Id:     credentialID,
-		Assert: txn.DocMissing,
-		Insert: credentails,
-	}, createSettingsOp("controllers", "controllerSettings", settings), {
-		C:      permissionsC,
-		Id:     fmt.Sprintf("c#%s#us#admin@local", context.controllerUUID),
-		Assert: txn.DocMissing,
-		Insert: bson.M{
-			"access":             "superuser",
-			"object-global-key":  "c#" + context.controllerUUID,
-			"subject-global-key": "us#admin@local",
-		},
-	}, {
-		C:      controllerusersC,
-		Id:     "admin@local",
-		Assert: txn.DocMissing,
-		Insert: bson.M{
-			"createdby":   "admin@local",
-			"datecreated": time.Date(2016, 11, 18, 12, 0, 0, 0, time.UTC),
-			"displayname": "admin",
-			"object-uuid": context.controllerUUID,
-			"user":        "admin@local",
-		},
-	}})
+	}}
+	modelCreds, distinct, err := modelCredentials(context, credentials)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if !context.live {
+		reportModelCredentials(context, modelCreds)
+	}
+	for _, credential := range distinct {
+		controllerOps = append(controllerOps, txn.Op{
+			C:      cloudCredentialsC,
+			Id:     credentialDocID(credential),
+			Assert: txn.DocMissing,
+			Insert: credential,
+		})
+	}
+	// The credential of each model is stored now, while every model still
+	// has its provider settings. update-models removes them in batches, so
+	// a re-run after a partial batch could not work the mapping out again.
+	var ops opGroups
+	uuids := make([]string, 0, len(modelCreds))
+	for uuid := range modelCreds {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		credential := modelCreds[uuid].credential
+		if credential == nil {
+			continue
+		}
+		ops.add(txn.Op{
+			C:      modelsC,
+			Id:     uuid,
+			Assert: txn.DocExists,
+			Update: bson.D{{"$set", bson.D{{"cloud-credential", credentialName(*credential)}}}},
+		})
+	}
+	userOps, err := controllerUserOps(context)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ops = append(ops, userOps...)
+	controllerOps = append(controllerOps, createSettingsOp("controllers", "controllerSettings", settings))
+	ops.add(controllerOps...)
+
+	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
+	if err := runner.RunGroups(ops); err != nil {
+		return errors.Trace(err)
+	}
 
 	context.controllerSettings = settings
 	return nil
 }
 
-func writeLXDCerts(controllerSettings b7.SettingsDoc, live bool) error {
-	if live {
+// localUserID returns the 2.0 id of a beta7 user name.
+func localUserID(name string) string {
+	name = strings.ToLower(name)
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return name + "@local"
+}
+
+// controllerUserOps returns the ops that give every user that has not been
+// deactivated a controllerusers doc and a permission on the controller, so
+// they can still log in. The access is login, except for the controller
+// owner who is superuser. Users that already have a permission, from an
+// earlier run that failed part way, are skipped.
+func controllerUserOps(context *dbUpgradeContext) (opGroups, error) {
+	var ops opGroups
+	var doc b7.UserDoc
+	iter := context.db.GetCollection(usersC).Find(nil).Sort("_id").Iter()
+	defer iter.Close()
+	for iter.Next(&doc) {
+		if doc.Deactivated {
+			context.Info(fmt.Sprintf("Skipping deactivated user %q", doc.Name))
+			continue
+		}
+		name := doc.Name
+		if name == "" {
+			name = doc.DocID
+		}
+		userID := localUserID(name)
+		createdBy := localUserID(context.owner)
+		if doc.CreatedBy != "" {
+			createdBy = localUserID(doc.CreatedBy)
+		}
+		access := "login"
+		if userID == localUserID(context.owner) {
+			access = "superuser"
+		}
+		permissionID := fmt.Sprintf("c#%s#us#%s", context.controllerUUID, userID)
+		exists, err := context.db.docExists(permissionsC, permissionID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if exists {
+			continue
+		}
+		ops.add(txn.Op{
+			C:      permissionsC,
+			Id:     permissionID,
+			Assert: txn.DocMissing,
+			Insert: bson.M{
+				"access":             access,
+				"object-global-key":  "c#" + context.controllerUUID,
+				"subject-global-key": "us#" + userID,
+			},
+		}, txn.Op{
+			C:      controllerusersC,
+			Id:     userID,
+			Assert: txn.DocMissing,
+			Insert: rc.UserAccessDoc{
+				ID:          userID,
+				ObjectUUID:  context.controllerUUID,
+				UserName:    userID,
+				DisplayName: doc.DisplayName,
+				CreatedBy:   createdBy,
+				DateCreated: doc.DateCreated,
+			},
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.Annotate(err, "reading users")
+	}
+	return ops, nil
+}
+
+// lxdCertFilenames maps the controller model settings holding the LXD
+// certs to the files they are written to.
+var lxdCertFilenames = map[string]string{
+	"client-cert": "/etc/juju/lxd-client.crt",
+	"client-key":  "/etc/juju/lxd-client.key",
+	"server-cert": "/etc/juju/lxd-server.crt",
+}
+
+// writeLXDCerts writes out the LXD client and server certificates from the
+// controller model settings, which are removed by updateModels.
+func writeLXDCerts(context *dbUpgradeContext) error {
+	if context.cloudType != "lxd" {
+		context.Info("Not an LXD controller, no certs to write")
+		return nil
+	}
+	context.Info("Writing LXD certs")
+	if context.live {
 		if err := os.MkdirAll("/etc/juju", 0755); err != nil {
 			return errors.Trace(err)
 		}
 	} else {
 		logger.Debugf("mkdir /etc/juju")
 	}
-	for _, action := range []struct {
-		setting  string
-		filename string
-	}{
-		{"client-cert", "lxd-client.crt"},
-		{"client-key", "lxd-client.key"},
-		{"server-cert", "lxd-server.crt"},
-	} {
-		content := controllerSettings.Settings[action.setting].(string)
-		filename := "/etc/juju/" + action.filename
-		if live {
+	for setting, filename := range lxdCertFilenames {
+		content, ok := context.controllerModelSettings.Settings[setting].(string)
+		if !ok {
+			return errors.Errorf("%q missing from controller model settings", setting)
+		}
+		if context.live {
 			err := ioutil.WriteFile(filename, []byte(content), 0600)
 			if err != nil {
 				return errors.Trace(err)
@@ -447,9 +777,16 @@ func updateModels(context *dbUpgradeContext) error {
 	fmt.Fprintln(context.cmdCtx.Stdout, "Updating models")
 	coll := context.db.GetCollection("models")
 
-	var ops []txn.Op
+	provider, err := getProviderUpgrade(context.cloudType)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	controllerModelUUID := context.db.ControllerModelUUID()
+	owner := localUserID(context.owner)
+
+	var ops opGroups
 	var doc b7.ModelDoc
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldModelsQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 
@@ -469,36 +806,32 @@ func updateModels(context *dbUpgradeContext) error {
 			"tools-metadata-url",
 		)
 
-		switch context.cloud {
-		case "lxd":
-			removed = removed.Union(set.NewStrings(
-				"client-cert",
-				"client-key",
-				"namespace",
-				"remote-url",
-				"server-cert",
-			))
-		case "maas":
-			removed = removed.Union(set.NewStrings(
-				"maas-server",
-				"maas-oauth",
-				"maas-agent-name",
-			))
-		default:
-			return errors.Errorf("unsupported cloud %q", context.cloud)
-		}
+		removed = removed.Union(set.NewStrings(provider.removedSettings...))
 
 		settingsKey := doc.UUID + ":e"
+		settings, err := modelSettings(context.db, doc.UUID)
+		if err != nil {
+			return errors.Trace(err)
+		}
 
+		// cloud-credential was set by update-controller.
 		updates := bson.D{
 			{"cloud", context.cloud},
-			{"cloud-credential", context.credential},
 			{"controller-uuid", context.controllerUUID},
 		}
-		if doc.Name == "admin" {
-			updates = append(updates, bson.DocElem{"name", "controller"})
+		if region := provider.modelRegion(settings); region != "" {
+			updates = append(updates, bson.DocElem{"cloud-region", region})
 		}
-		ops = append(ops, txn.Op{
+		name := doc.Name
+		if doc.UUID == controllerModelUUID && name == "admin" {
+			name = "controller"
+			updates = append(updates, bson.DocElem{"name", name})
+		}
+		nameOps, err := userModelNameOps(context, doc, name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ops.add(append(nameOps, txn.Op{
 			C:      modelsC,
 			Id:     doc.UUID,
 			Assert: txn.DocExists,
@@ -508,12 +841,12 @@ func updateModels(context *dbUpgradeContext) error {
 			},
 		}, txn.Op{
 			C:      permissionsC,
-			Id:     fmt.Sprintf("e#%s#us#admin@local", doc.UUID),
+			Id:     fmt.Sprintf("e#%s#us#%s", doc.UUID, owner),
 			Assert: txn.DocMissing,
 			Insert: bson.M{
 				"access":             "admin",
 				"object-global-key":  "e#" + doc.UUID,
-				"subject-global-key": "us#admin@local",
+				"subject-global-key": "us#" + owner,
 			},
 		}, txn.Op{
 			C:      settingsC,
@@ -527,121 +860,81 @@ func updateModels(context *dbUpgradeContext) error {
 				}},
 				{"$unset", removeSettingsBSOND(removed)},
 			},
-		})
+		})...)
 	}
-	ops = append(ops, txn.Op{
-		C:      usermodelnameC,
-		Id:     "admin@local:admin",
-		Assert: txn.DocExists,
-		Remove: true,
-	}, txn.Op{
-		C:      usermodelnameC,
-		Id:     "admin@local:controller",
-		Assert: txn.DocMissing,
-		Insert: bson.M{},
-	})
-
 	if err := iter.Err(); err != nil {
 		return errors.Annotate(err, "failed to read models")
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
-func renameServiceToApplication(context *dbUpgradeContext) error {
-	context.Info("Renaming services to applications")
-	if err := moveDocsFromServicesToApplications(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateUnits(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateSequences(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateLeases(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateModelEntityRefs(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateRelations(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateResources(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateCollectionIDGlobalKey(context, annotationC, "globalkey"); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateCollectionIDGlobalKey(context, constraintsC, ""); err != nil {
-		return errors.Trace(err)
-	}
-	if err := updateCollectionIDGlobalKey(context, endpointbindingsC, ""); err != nil {
-		return errors.Trace(err)
+// userModelNameOps returns the ops that make sure the usermodelname entry
+// for the model matches its owner and new name. A renamed model's old
+// entry is removed if it is there.
+func userModelNameOps(context *dbUpgradeContext, model b7.ModelDoc, name string) ([]txn.Op, error) {
+	owner := localUserID(model.Owner)
+	newID := owner + ":" + name
+	var ops []txn.Op
+	if name != model.Name {
+		oldID := owner + ":" + model.Name
+		exists, err := context.db.docExists(usermodelnameC, oldID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if exists {
+			ops = append(ops, txn.Op{
+				C:      usermodelnameC,
+				Id:     oldID,
+				Assert: txn.DocExists,
+				Remove: true,
+			})
+		}
 	}
-	if err := updateCollectionIDGlobalKey(context, settingsC, ""); err != nil {
-		return errors.Trace(err)
+	exists, err := context.db.docExists(usermodelnameC, newID)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
-	if err := updateCollectionIDGlobalKey(context, statusesC, ""); err != nil {
-		return errors.Trace(err)
+	if !exists {
+		ops = append(ops, txn.Op{
+			C:      usermodelnameC,
+			Id:     newID,
+			Assert: txn.DocMissing,
+			Insert: bson.M{},
+		})
 	}
-	if err := updateStatusHistoryCollection(context); err != nil {
+	return ops, nil
+}
+
+// dropOldCollections removes the collections that were replaced: services by
+// applications, and settingsrefs by refcounts. The legacy ipaddresses
+// collection is checked to be empty by the precheck.
+func dropOldCollections(context *dbUpgradeContext) error {
+	collections, err := context.db.Collections()
+	if err != nil {
 		return errors.Trace(err)
 	}
-	// Remove old settingsrefs collection.
-	if context.live {
-		if err := context.db.GetCollection(serviceC).DropCollection(); err != nil {
-			return errors.Annotate(err, "drop services")
+	for _, name := range []string{serviceC, settingsrefsC, "ipaddresses"} {
+		// An earlier run may have stopped after dropping some of them.
+		if !collections.Contains(name) {
+			context.Info("No", name, "collection, already dropped.")
+			context.db.audit(auditEntry{Live: context.live, Action: "skip-drop-collection", Collection: name, Detail: "collection is missing"}, nil)
+			continue
 		}
-		if err := context.db.GetCollection(settingsrefsC).DropCollection(); err != nil {
-			return errors.Annotate(err, "drop settings refs")
+		context.Info("Drop", name, "collection.")
+		var err error
+		if context.live {
+			err = dropCollectionIfExists(context.db.GetCollection(name))
 		}
-		if err := context.db.GetCollection("ipaddresses").DropCollection(); err != nil {
-			return errors.Annotate(err, "drop ipaddresses")
+		context.db.audit(auditEntry{Live: context.live, Action: "drop-collection", Collection: name}, err)
+		if err != nil {
+			return errors.Annotatef(err, "drop %s", name)
 		}
-	} else {
-		context.Info("Drop", serviceC, "collection.")
-		context.Info("Drop", settingsrefsC, "collection.")
-		context.Info("Drop", "ipaddresses", "collection.")
 	}
 	return nil
 }
 
-func otherSchemaUpgrades(context *dbUpgradeContext) error {
-	context.Info("Other DB upgrades")
-	if err := upgradeCharms(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeUsersCollection(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeModelUsersCollection(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeMachinesCollection(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeCloudImageMetadata(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeSpaces(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeSubnets(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeLinkLayerDevices(context); err != nil {
-		return errors.Trace(err)
-	}
-	if err := upgradeIPAddresses(context); err != nil {
-		return errors.Trace(err)
-	}
-
-	return nil
-}
-
 func moveDocsFromServicesToApplications(context *dbUpgradeContext) error {
 	fmt.Fprintln(context.cmdCtx.Stdout, "Moving documents from services collection to applications")
 	coll := context.db.GetCollection(serviceC)
@@ -713,6 +1006,8 @@ func moveDocsFromServicesToApplications(context *dbUpgradeContext) error {
 		return errors.Annotate(err, "failed to read services")
 	}
 
+	// The refcounts are totals over all the services, so the whole step
+	// has to be run as a single transaction.
 	for key, value := range refCounts {
 		uuid, _, _ := splitDocID(key)
 		ops = append(ops, txn.Op{
@@ -734,15 +1029,15 @@ func updateUnits(context *dbUpgradeContext) error {
 	fmt.Fprintln(context.cmdCtx.Stdout, "Updating units")
 	coll := context.db.GetCollection(unitC)
 
-	var ops []txn.Op
+	var ops opGroups
 	updated := time.Now().UnixNano()
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldUnitsQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 		workloadStatusID := fmt.Sprintf("%s:u#%s#charm#sat#workload-version", doc["model-uuid"], doc["name"])
-		ops = append(ops, txn.Op{
+		ops.add(txn.Op{
 			C:      unitC,
 			Id:     doc["_id"],
 			Assert: txn.DocExists,
@@ -770,29 +1065,20 @@ func updateUnits(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func updateLeases(context *dbUpgradeContext) error {
 	context.Info("Updating leases")
 	coll := context.db.GetCollection(leasesC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldLeasesQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 		oldID := getStringField(doc, "_id")
-		namespace, ok := readBsonDField(doc, "namespace")
-		if namespace == "application-leadership" {
-			return errors.Errorf("lease doc already has application-leadership: %q", oldID)
-		}
-		if !ok || namespace != "service-leadership" {
-			logger.Debugf("skipping lease with id %q", oldID)
-			continue
-		}
-
 		data := copyBsonDField(doc)
 		replaceBsonDField(data, "namespace", "application-leadership")
 
@@ -801,8 +1087,7 @@ func updateLeases(context *dbUpgradeContext) error {
 			newID += name + "#"
 		}
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      leasesC,
 				Id:     oldID,
@@ -822,23 +1107,22 @@ func updateLeases(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func updateModelEntityRefs(context *dbUpgradeContext) error {
 	context.Info("Updating modelEntityRefs")
 	coll := context.db.GetCollection(modelEntityRefsC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldModelEntityRefsQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 
 		apps := doc["services"]
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      modelEntityRefsC,
 				Id:     doc["_id"],
@@ -855,17 +1139,17 @@ func updateModelEntityRefs(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func updateRelations(context *dbUpgradeContext) error {
 	context.Info("Updating relations")
 	coll := context.db.GetCollection(relationsC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldRelationsQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 		var setFields bson.D
@@ -883,8 +1167,7 @@ func updateRelations(context *dbUpgradeContext) error {
 			setFields = append(setFields, bson.DocElem{prefix + "applicationname", epData["servicename"]})
 			unsetFields = append(unsetFields, bson.DocElem{prefix + "servicename", nil})
 		}
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      relationsC,
 				Id:     doc["_id"],
@@ -901,23 +1184,22 @@ func updateRelations(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func updateResources(context *dbUpgradeContext) error {
 	context.Info("Updating resources")
 	coll := context.db.GetCollection(resourcesC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldResourcesQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 		appID := doc["service-id"]
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      resourcesC,
 				Id:     doc["_id"],
@@ -934,21 +1216,20 @@ func updateResources(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeCharms(context *dbUpgradeContext) error {
 	context.Info("Updating charms")
 	coll := context.db.GetCollection(charmsC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldCharmsQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      charmsC,
 				Id:     doc["_id"],
@@ -964,21 +1245,20 @@ func upgradeCharms(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeUsersCollection(context *dbUpgradeContext) error {
 	context.Info("Updating users")
 	coll := context.db.GetCollection(usersC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldUsersQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      usersC,
 				Id:     doc["_id"],
@@ -994,48 +1274,95 @@ func upgradeUsersCollection(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeModelUsersCollection(context *dbUpgradeContext) error {
 	context.Info("Updating model users")
 	coll := context.db.GetCollection(modelusersC)
 
-	var ops []txn.Op
+	var ops opGroups
+	var unmapped []string
+	// Two model users can map to the same permission, which the
+	// database can't show until the ops have run.
+	seen := set.NewStrings()
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldModelUsersQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
-		ops = append(
-			ops,
-			txn.Op{
-				C:      modelusersC,
-				Id:     doc["_id"],
-				Assert: txn.DocExists,
-				Update: bson.D{
-					{"$set", bson.D{{"object-uuid", doc["model-uuid"]}}},
-					{"$unset", bson.D{{"access", nil}}},
-				},
+		group := []txn.Op{{
+			C:      modelusersC,
+			Id:     doc["_id"],
+			Assert: txn.DocExists,
+			Update: bson.D{
+				{"$set", bson.D{{"object-uuid", doc["model-uuid"]}}},
+				{"$unset", bson.D{{"access", nil}}},
 			},
-		)
+		}}
+
+		modelUUID, _ := doc["model-uuid"].(string)
+		user, _ := doc["user"].(string)
+		access, _ := doc["access"].(string)
+		if !modelAccessLevels.Contains(access) {
+			unmapped = append(unmapped, fmt.Sprintf("%s on model %s: access %q not known, no permission", user, modelUUID, access))
+			ops.add(group...)
+			continue
+		}
+		user = localUserID(user)
+		permissionID := fmt.Sprintf("e#%s#us#%s", modelUUID, user)
+		if seen.Contains(permissionID) {
+			unmapped = append(unmapped, fmt.Sprintf("%s on model %s: access %q not used, same user as an earlier model user", user, modelUUID, access))
+			ops.add(group...)
+			continue
+		}
+		seen.Add(permissionID)
+		exists, err := context.db.docExists(permissionsC, permissionID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !exists {
+			group = append(group, txn.Op{
+				C:      permissionsC,
+				Id:     permissionID,
+				Assert: txn.DocMissing,
+				Insert: bson.M{
+					"access":             access,
+					"object-global-key":  "e#" + modelUUID,
+					"subject-global-key": "us#" + user,
+				},
+			})
+		}
+		ops.add(group...)
 	}
 	if err := iter.Err(); err != nil {
 		return errors.Annotatef(err, "failed to read model users")
 	}
 
+	if len(unmapped) > 0 {
+		context.Info("Model users whose access could not be mapped:")
+		for _, line := range unmapped {
+			context.Info("  " + line)
+			context.addNote(line)
+		}
+	}
+
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
+// modelAccessLevels are the beta7 model user access levels, which are
+// the same in the 2.0 permissions collection.
+var modelAccessLevels = set.NewStrings("read", "write", "admin")
+
 func upgradeMachinesCollection(context *dbUpgradeContext) error {
 	context.Info("Updating machines")
 	coll := context.db.GetCollection(machinesC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc b7.MachineDoc
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldMachinesQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 
@@ -1046,8 +1373,7 @@ func upgradeMachinesCollection(context *dbUpgradeContext) error {
 			}
 		}
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      machinesC,
 				Id:     doc.DocID,
@@ -1063,14 +1389,14 @@ func upgradeMachinesCollection(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeSpaces(context *dbUpgradeContext) error {
 	context.Info("Updating spaces")
 	coll := context.db.GetCollection(spacesC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
 	iter := coll.Find(nil).Iter()
@@ -1082,8 +1408,7 @@ func upgradeSpaces(context *dbUpgradeContext) error {
 
 		if strings.HasPrefix(providerID, modelUUID) {
 			providerID = providerID[len(modelUUID)+1:]
-			ops = append(
-				ops,
+			ops.add(
 				txn.Op{
 					C:      spacesC,
 					Id:     getStringField(doc, "_id"),
@@ -1108,14 +1433,14 @@ func upgradeSpaces(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeSubnets(context *dbUpgradeContext) error {
 	context.Info("Updating subnets")
 	coll := context.db.GetCollection(subnetsC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
 	iter := coll.Find(nil).Iter()
@@ -1127,8 +1452,7 @@ func upgradeSubnets(context *dbUpgradeContext) error {
 
 		if strings.HasPrefix(providerID, modelUUID) {
 			providerID = providerID[len(modelUUID)+1:]
-			ops = append(
-				ops,
+			ops.add(
 				txn.Op{
 					C:      subnetsC,
 					Id:     getStringField(doc, "_id"),
@@ -1153,14 +1477,14 @@ func upgradeSubnets(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeLinkLayerDevices(context *dbUpgradeContext) error {
 	context.Info("Updating link layer devices")
 	coll := context.db.GetCollection(linklayerdevicesC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
 	iter := coll.Find(nil).Iter()
@@ -1172,8 +1496,7 @@ func upgradeLinkLayerDevices(context *dbUpgradeContext) error {
 
 		if strings.HasPrefix(providerID, modelUUID) {
 			providerID = providerID[len(modelUUID)+1:]
-			ops = append(
-				ops,
+			ops.add(
 				txn.Op{
 					C:      linklayerdevicesC,
 					Id:     getStringField(doc, "_id"),
@@ -1198,14 +1521,14 @@ func upgradeLinkLayerDevices(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeIPAddresses(context *dbUpgradeContext) error {
 	context.Info("Updating ip.addresses")
 	coll := context.db.GetCollection(ipAddressesC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
 	iter := coll.Find(nil).Iter()
@@ -1217,8 +1540,7 @@ func upgradeIPAddresses(context *dbUpgradeContext) error {
 
 		if strings.HasPrefix(providerID, modelUUID) {
 			providerID = providerID[len(modelUUID)+1:]
-			ops = append(
-				ops,
+			ops.add(
 				txn.Op{
 					C:      ipAddressesC,
 					Id:     getStringField(doc, "_id"),
@@ -1243,17 +1565,17 @@ func upgradeIPAddresses(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func upgradeCloudImageMetadata(context *dbUpgradeContext) error {
 	context.Info("Updating cloudimagemetadata")
 	coll := context.db.GetCollection(cloudimagemetadataC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldCloudImageMetadataQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 		oldID := getStringField(doc, "_id")
@@ -1265,8 +1587,7 @@ func upgradeCloudImageMetadata(context *dbUpgradeContext) error {
 		data := copyBsonDField(doc)
 		removeBsonDField(data, "model-uuid")
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      cloudimagemetadataC,
 				Id:     oldID,
@@ -1286,17 +1607,17 @@ func upgradeCloudImageMetadata(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func updateCollectionIDGlobalKey(context *dbUpgradeContext, collection string, keyName string) error {
 	fmt.Fprintln(context.cmdCtx.Stdout, "Updating", collection)
 	coll := context.db.GetCollection(collection)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldGlobalKeyIDQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 		oldID := getStringField(doc, "_id")
@@ -1318,8 +1639,7 @@ func updateCollectionIDGlobalKey(context *dbUpgradeContext, collection string, k
 		// be fine to just call delete on the map.
 		removeBsonDField(data, "env-uuid")
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      collection,
 				Id:     oldID,
@@ -1339,7 +1659,7 @@ func updateCollectionIDGlobalKey(context *dbUpgradeContext, collection string, k
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func updateStatusHistoryCollection(context *dbUpgradeContext) error {
@@ -1347,7 +1667,7 @@ func updateStatusHistoryCollection(context *dbUpgradeContext) error {
 	coll := context.db.GetCollection(statusHistoryC)
 
 	var doc bson.M
-	iter := coll.Find(nil).Iter()
+	iter := coll.Find(oldStatusHistoryQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 
@@ -1357,14 +1677,18 @@ func updateStatusHistoryCollection(context *dbUpgradeContext) error {
 		}
 
 		newKey := "a" + key[1:]
+		update := bson.D{{"$set", bson.D{{"globalkey", newKey}}}}
 
+		var err error
 		if context.live {
-			if err := coll.UpdateId(doc["_id"], bson.D{{"$set", bson.D{{"globalkey", newKey}}}}); err != nil {
-				return errors.Trace(err)
-			}
+			err = coll.UpdateId(doc["_id"], update)
 		} else {
 			logger.Debugf("update %q, set globalkey to %q", doc["_id"].(bson.ObjectId), newKey)
 		}
+		context.db.audit(auditEntry{Live: context.live, Action: "update-id", Collection: statusHistoryC, ID: doc["_id"], Detail: update}, err)
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 	if err := iter.Err(); err != nil {
 		return errors.Annotatef(err, "failed to status history")
@@ -1376,10 +1700,10 @@ func updateSequences(context *dbUpgradeContext) error {
 	fmt.Fprintln(context.cmdCtx.Stdout, "Updating sequences")
 	sequences := context.db.GetCollection(sequenceC)
 
-	var ops []txn.Op
+	var ops opGroups
 
 	var doc bson.D
-	iter := sequences.Find(nil).Iter()
+	iter := sequences.Find(oldSequencesQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 		serviceTag, err := b7.ParseServiceTag(getStringField(doc, "name"))
@@ -1396,8 +1720,7 @@ func updateSequences(context *dbUpgradeContext) error {
 		replaceBsonDField(data, "_id", newID)
 		replaceBsonDField(data, "name", appTag.String())
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      sequenceC,
 				Id:     getStringField(doc, "_id"),
@@ -1417,23 +1740,19 @@ func updateSequences(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func updateAgentTools(context *dbUpgradeContext) error {
 	context.Info("Updating tools field on units and machines")
-	var ops []txn.Op
-
-	// This code assumes a homogeneous environment of xenial amd64 machines.
-	const agentVersion = "2.0.0-xenial-amd64"
+	var ops opGroups
 
 	var doc bson.M
-	iter := context.db.GetCollection(machinesC).Find(nil).Iter()
+	iter := context.db.GetCollection(machinesC).Find(oldAgentToolsQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      machinesC,
 				Id:     doc["_id"],
@@ -1448,12 +1767,11 @@ func updateAgentTools(context *dbUpgradeContext) error {
 		return errors.Annotatef(err, "failed to read machines for version update")
 	}
 
-	iter = context.db.GetCollection(unitC).Find(nil).Iter()
+	iter = context.db.GetCollection(unitC).Find(oldAgentToolsQuery).Iter()
 	defer iter.Close()
 	for iter.Next(&doc) {
 
-		ops = append(
-			ops,
+		ops.add(
 			txn.Op{
 				C:      unitC,
 				Id:     doc["_id"],
@@ -1469,7 +1787,7 @@ func updateAgentTools(context *dbUpgradeContext) error {
 	}
 
 	runner := context.db.TransactionRunner(context.cmdCtx, context.live)
-	return errors.Trace(runner.RunTransaction(ops))
+	return errors.Trace(runner.RunGroups(ops))
 }
 
 func createSettingsOp(collection, key string, values map[string]interface{}) txn.Op {
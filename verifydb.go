@@ -20,6 +20,8 @@ func (c *upgrade) verifyDB(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 
+	c.setResult(verifyDBResult{Server: server, Models: models})
+
 	ctx.Infof("Server Machine:")
 	ctx.Infof("  %s, %s, %s\n\n", server.Model, server.ID, server.Address)
 
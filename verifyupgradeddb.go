@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// upgradedDBCheck is an invariant that should hold once upgrade-db has
+// been run.
+type upgradedDBCheck struct {
+	collection  string
+	description string
+	// absent is true if the collection should no longer exist.
+	absent bool
+	// query matches the documents that break the invariant.
+	query bson.D
+	// offending, if set, is used instead of query to find the documents
+	// that break the invariant.
+	offending func(db *database) ([]string, error)
+}
+
+func missingOrEmpty(field string) bson.D {
+	return bson.D{{"$or", []bson.D{
+		{{field, bson.D{{"$exists", false}}}},
+		{{field, ""}},
+	}}}
+}
+
+var upgradedDBChecks = []upgradedDBCheck{{
+	collection:  serviceC,
+	description: "services collection has been dropped",
+	absent:      true,
+}, {
+	collection:  settingsrefsC,
+	description: "settingsrefs collection has been dropped",
+	absent:      true,
+}, {
+	collection:  unitC,
+	description: "every unit has application and no service",
+	query: bson.D{{"$or", []bson.D{
+		{{"application", bson.D{{"$exists", false}}}},
+		{{"service", bson.D{{"$exists", true}}}},
+	}}},
+}, {
+	collection:  statusesC,
+	description: "no service global keys",
+	query:       oldGlobalKeyIDQuery,
+}, {
+	collection:  constraintsC,
+	description: "no service global keys",
+	query:       oldGlobalKeyIDQuery,
+}, {
+	collection:  settingsC,
+	description: "no service global keys",
+	query:       oldGlobalKeyIDQuery,
+}, {
+	collection:  annotationC,
+	description: "no service global keys",
+	query:       oldGlobalKeyIDQuery,
+}, {
+	collection:  endpointbindingsC,
+	description: "no service global keys",
+	query:       oldGlobalKeyIDQuery,
+}, {
+	collection:  statusHistoryC,
+	description: "no service global keys",
+	query:       oldStatusHistoryQuery,
+}, {
+	collection:  modelsC,
+	description: "every model has controller-uuid",
+	query:       missingOrEmpty("controller-uuid"),
+}, {
+	collection:  modelsC,
+	description: "every model has cloud",
+	query:       missingOrEmpty("cloud"),
+}, {
+	collection:  modelsC,
+	description: "every model has cloud-credential, unless its cloud has none",
+	query: bson.D{{"$and", []bson.D{
+		{{"cloud", bson.D{{"$nin", cloudsWithoutCredentials()}}}},
+		missingOrEmpty("cloud-credential"),
+	}}},
+}, {
+	collection:  modelsC,
+	description: "every cloud-credential refers to a cloudCredentials doc",
+	offending:   missingModelCredentials,
+}, {
+	collection:  modelsC,
+	description: "no model has server-uuid",
+	query:       oldModelsQuery,
+}, {
+	collection:  relationsC,
+	description: "every relation endpoint has applicationname",
+	query: bson.D{{"endpoints", bson.D{{"$elemMatch", bson.D{
+		{"applicationname", bson.D{{"$exists", false}}},
+	}}}}},
+}, {
+	collection:  sequenceC,
+	description: "no service sequences",
+	query:       oldSequencesQuery,
+}, {
+	collection:  leasesC,
+	description: "no service-leadership leases",
+	query:       oldLeasesQuery,
+}, {
+	collection:  modelEntityRefsC,
+	description: "no services field",
+	query:       oldModelEntityRefsQuery,
+}, {
+	collection:  resourcesC,
+	description: "every resource has application-id and no service-id",
+	query: bson.D{{"$or", []bson.D{
+		{{"application-id", bson.D{{"$exists", false}}}},
+		{{"service-id", bson.D{{"$exists", true}}}},
+	}}},
+}, {
+	collection:  modelusersC,
+	description: "every model user has object-uuid",
+	query:       oldModelUsersQuery,
+}, {
+	collection:  cloudimagemetadataC,
+	description: "no model-uuid on cloud image metadata",
+	query:       oldCloudImageMetadataQuery,
+}, {
+	collection:  machinesC,
+	description: "every machine has 2.0 tools",
+	query:       oldAgentToolsQuery,
+}, {
+	collection:  unitC,
+	description: "every unit has 2.0 tools",
+	query:       oldAgentToolsQuery,
+}}
+
+// missingModelCredentials returns the models whose cloud-credential has
+// no matching cloudCredentials doc.
+func missingModelCredentials(db *database) ([]string, error) {
+	var offending []string
+	var doc struct {
+		UUID       string `bson:"_id"`
+		Credential string `bson:"cloud-credential"`
+	}
+	query := bson.D{{"cloud-credential", bson.D{{"$nin", []interface{}{nil, ""}}}}}
+	iter := db.GetCollection(modelsC).Find(query).Iter()
+	for iter.Next(&doc) {
+		parts := strings.Split(doc.Credential, "/")
+		if len(parts) != 3 {
+			offending = append(offending, fmt.Sprintf("%s: bad cloud-credential %q", doc.UUID, doc.Credential))
+			continue
+		}
+		count, err := db.GetCollection(cloudCredentialsC).FindId(strings.Join(parts, "#")).Count()
+		if err != nil {
+			iter.Close()
+			return nil, errors.Trace(err)
+		}
+		if count == 0 {
+			offending = append(offending, fmt.Sprintf("%s: %s", doc.UUID, doc.Credential))
+		}
+	}
+	return offending, errors.Trace(iter.Close())
+}
+
+// verifyUpgradedDB checks that the database looks like a valid 2.0 rc
+// database, reporting a pass or fail for each check along with the ids of
+// the documents that caused a failure.
+func (c *upgrade) verifyUpgradedDB(ctx *cmd.Context) error {
+	if len(c.args) > 0 {
+		return errors.Errorf("unexpected args: %v", c.args)
+	}
+
+	db, err := NewDatabase()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+
+	collections, err := db.Collections()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	failed := 0
+	var results []checkResult
+	defer func() {
+		c.setResult(results)
+	}()
+	for _, check := range upgradedDBChecks {
+		var offending []string
+		if check.absent {
+			if collections.Contains(check.collection) {
+				offending = append(offending, "collection exists")
+			}
+		} else if check.offending != nil {
+			offending, err = check.offending(db)
+			if err != nil {
+				return errors.Annotatef(err, "checking %s", check.collection)
+			}
+		} else {
+			var doc struct {
+				ID interface{} `bson:"_id"`
+			}
+			iter := db.GetCollection(check.collection).Find(check.query).Select(bson.M{"_id": 1}).Iter()
+			for iter.Next(&doc) {
+				offending = append(offending, fmt.Sprint(doc.ID))
+			}
+			if err := iter.Close(); err != nil {
+				return errors.Annotatef(err, "checking %s", check.collection)
+			}
+		}
+
+		results = append(results, checkResult{
+			Collection:  check.collection,
+			Description: check.description,
+			Passed:      len(offending) == 0,
+			Offending:   offending,
+		})
+		if len(offending) == 0 {
+			ctx.Infof("PASS %s: %s", check.collection, check.description)
+			continue
+		}
+		failed++
+		ctx.Infof("FAIL %s: %s", check.collection, check.description)
+		for _, id := range offending {
+			ctx.Infof("    %s", id)
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d checks failed", failed, len(upgradedDBChecks))
+	}
+	return nil
+}